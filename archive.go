@@ -0,0 +1,178 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExportTemplate writes the template name in dir to w as a gzip compressed
+// tar archive which can be restored using ImportTemplate. dir and name have
+// the same behaviour as in Freeze. Only templates with a manifest can be
+// exported. This allows a template to be built once and shipped, for
+// example as a CI artifact, instead of running initdb on every machine.
+func ExportTemplate(dir, name string, w io.Writer) (err error) {
+	defer recoverFault(&err)
+	t := newTemplate(dir, name)
+	defer t.lock(context.Background(), false).unlock()
+	requireTrue(t.exists(), fmt.Errorf("%s: template does not exist", t.path()))
+	check.Return(t.readManifest())
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	// Every entry is prefixed with <name>/<version>/ which is also the first
+	// entry so that ImportTemplate knows where to place the template.
+	prefix := path.Join(filepath.Base(filepath.Dir(t.path())), filepath.Base(t.path()))
+	check.Error(filepath.Walk(t.path(), func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(t.path(), file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(prefix, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}))
+	check.Error(tw.Close())
+	return gz.Close()
+}
+
+// ImportTemplate restores a template written by ExportTemplate into dir and
+// returns it. dir has the same behaviour as in Freeze. An error wrapping
+// ErrTemplateExists is returned if the template already exists and one
+// wrapping ErrTemplateInvalid if its data does not match its manifest.
+func ImportTemplate(dir string, r io.Reader) (info TemplateInfo, err error) {
+	defer recoverFault(&err)
+	if dir == DefaultTemplateDir {
+		dir = templateStore()
+	}
+	gz := check.Return(gzip.NewReader(r)).(*gzip.Reader)
+	tr := tar.NewReader(gz)
+	first := check.Return(tr.Next()).(*tar.Header)
+	parts := strings.Split(strings.TrimSuffix(first.Name, "/"), "/")
+	requireTrue(first.Typeflag == tar.TypeDir && len(parts) == 2 && validPathElem(parts[0]) && validPathElem(parts[1]),
+		fmt.Errorf("%w: unexpected archive entry %s", ErrTemplateInvalid, first.Name))
+	name, version := parts[0], parts[1]
+	t := ghostgresTemplate(filepath.Join(dir, name, version))
+
+	defer t.lock(context.Background(), true).unlock()
+	requireTrue(!t.exists(), fmt.Errorf("%s: %w", t.path(), ErrTemplateExists))
+	staging := check.Return(ioutil.TempDir(filepath.Dir(t.path()), t.stagingPrefix())).(string)
+	published := false
+	defer func() {
+		if !published {
+			os.RemoveAll(staging)
+		}
+	}()
+	check.Error(extractTemplate(tr, name+"/"+version+"/", staging))
+
+	m := check.Return(ghostgresTemplate(staging).readManifest()).(*Manifest)
+	checksum := check.Return(dataChecksum(filepath.Join(staging, "data"))).(string)
+	requireTrue(checksum == m.Checksum, fmt.Errorf("%s: %w: checksum mismatch", t.path(), ErrTemplateInvalid))
+	check.Error(os.RemoveAll(t.path()))
+	check.Error(os.Rename(staging, t.path()))
+	published = true
+	return t.info(name, version), nil
+}
+
+func validPathElem(elem string) bool {
+	return elem != "" && elem != "." && elem != ".." && !strings.ContainsAny(elem, `/\`)
+}
+
+// extractTemplate extracts the entries of tr below prefix into dest. Symbolic
+// links are created once all files have been written so that no file can be
+// written through one.
+func extractTemplate(tr *tar.Reader, prefix, dest string) error {
+	type entry struct {
+		target string
+		header *tar.Header
+	}
+	var dirs, links []entry
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		relPath := strings.TrimPrefix(header.Name, prefix)
+		cleaned := path.Clean(relPath)
+		if !strings.HasPrefix(header.Name, prefix) || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("%w: unexpected archive entry %s", ErrTemplateInvalid, header.Name)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(cleaned))
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, entry{target, header})
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Chmod(target, mode)
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, entry{target, header})
+		default:
+			return fmt.Errorf("%w: unsupported archive entry %s", ErrTemplateInvalid, header.Name)
+		}
+	}
+	for _, link := range links {
+		if err := os.Symlink(link.header.Linkname, link.target); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].target, os.FileMode(dirs[i].header.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *PostgresSuite) TestExportImportTemplate(c *C) {
+	cluster := initdb(c)
+	c.Assert(os.Symlink("PG_VERSION", filepath.Join(cluster.DataDir, "version_link")), IsNil)
+	src := c.MkDir()
+	c.Assert(cluster.Freeze(src, "exported"), IsNil)
+
+	var archive bytes.Buffer
+	c.Assert(ExportTemplate(src, "exported", &archive), IsNil)
+	data := archive.Bytes()
+
+	dest := c.MkDir()
+	info, err := ImportTemplate(dest, bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, "exported")
+	c.Assert(info.Version, Equals, postgresVersion())
+	c.Assert(info.Manifest, Not(IsNil))
+	link, err := os.Readlink(filepath.Join(info.Path, "data", "version_link"))
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "PG_VERSION")
+
+	_, err = ImportTemplate(dest, bytes.NewReader(data))
+	c.Assert(errors.Is(err, ErrTemplateExists), Equals, true)
+
+	cloned, err := FromTemplate(dest, "exported", filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, IsNil)
+	CheckCluster(cloned, c)
+}
+
+func (s *PostgresSuite) TestImportTemplateBinDir(c *C) {
+	binDir := fakeBinDir(c, "9.3.5")
+	oldBinDir := *pgBinDir
+	defer func() { *pgBinDir = oldBinDir }()
+	*pgBinDir = binDir
+	src := c.MkDir()
+	fakeTemplate(c, src, "tpl", "9.3.5", time.Now())
+	t := ghostgresTemplate(filepath.Join(src, "tpl", "9.3.5"))
+	c.Assert(ioutil.WriteFile(filepath.Join(t.data(), "postgresql.conf"), nil, 0600), IsNil)
+	// The template was built on a machine with a different postgres layout.
+	config, err := json.Marshal(PostgresCluster{BinDir: "/other/machine/bin", DataDir: "/other/machine/data"})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(t.config(), config, 0600), IsNil)
+	checksum, err := dataChecksum(t.data())
+	c.Assert(err, IsNil)
+	manifest, err := json.Marshal(Manifest{Version: manifestVersion, PostgresVersion: fullPostgresVersion(binDir), Checksum: checksum})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(t.manifestPath(), manifest, 0600), IsNil)
+
+	var archive bytes.Buffer
+	c.Assert(ExportTemplate(src, "tpl", &archive), IsNil)
+	dest := c.MkDir()
+	_, err = ImportTemplate(dest, &archive)
+	c.Assert(err, IsNil)
+
+	cloned := newTemplateFor(dest, "tpl", binDir).clone(binDir, filepath.Join(c.MkDir(), "clone"), nil)
+	c.Assert(cloned.BinDir, Equals, binDir)
+
+	// Without a BinDir the postgres in PATH is used for the clone as well as
+	// for verifying the template.
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	c.Assert(os.Setenv("PATH", binDir), IsNil)
+	cloned = newTemplateFor(dest, "tpl", binDir).clone("", filepath.Join(c.MkDir(), "clone"), nil)
+	c.Assert(cloned.BinDir, Equals, binDir)
+}
+
+// testArchive builds a gzipped tar containing files, in order.
+func testArchive(c *C, files ...tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range files {
+		header := header
+		content := []byte("content")
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		c.Assert(tw.WriteHeader(&header), IsNil)
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write(content)
+			c.Assert(err, IsNil)
+		}
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	return &buf
+}
+
+func (s *PostgresSuite) TestImportTemplateInvalid(c *C) {
+	root := tar.Header{Name: "tpl/9.3.5/", Typeflag: tar.TypeDir, Mode: 0700}
+	for _, archive := range []*bytes.Buffer{
+		testArchive(c, tar.Header{Name: "../9.3.5/", Typeflag: tar.TypeDir, Mode: 0700}),
+		testArchive(c, tar.Header{Name: "tpl/", Typeflag: tar.TypeDir, Mode: 0700}),
+		testArchive(c, root, tar.Header{Name: "tpl/9.3.5/../../escaped", Typeflag: tar.TypeReg, Mode: 0600}),
+		testArchive(c, root, tar.Header{Name: "other/9.3.5/file", Typeflag: tar.TypeReg, Mode: 0600}),
+		testArchive(c, root, tar.Header{Name: "tpl/9.3.5/fifo", Typeflag: tar.TypeFifo, Mode: 0600}),
+		// No manifest
+		testArchive(c, root, tar.Header{Name: "tpl/9.3.5/ghostgres.json", Typeflag: tar.TypeReg, Mode: 0600}),
+	} {
+		dir := c.MkDir()
+		_, err := ImportTemplate(dir, archive)
+		c.Assert(errors.Is(err, ErrTemplateInvalid), Equals, true, Commentf("%v", err))
+		_, err = os.Stat(filepath.Join(filepath.Dir(dir), "escaped"))
+		c.Assert(os.IsNotExist(err), Equals, true)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "tpl"))
+		if err == nil {
+			// Only the lock file is left behind.
+			c.Assert(len(entries) <= 1, Equals, true)
+		}
+	}
+}
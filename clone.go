@@ -0,0 +1,128 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"errors"
+	"fmt"
+	surulio "github.com/surullabs/goutil/io"
+	surultpl "github.com/surullabs/goutil/template"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloneOption configures the clones created by Clone and FromTemplate.
+type CloneOption func(*cloneOptions)
+
+type cloneOptions struct {
+	freePort  bool
+	ephemeral bool
+	strategy  CloneStrategy
+}
+
+func newCloneOptions(opts []CloneOption) *cloneOptions {
+	o := &cloneOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithFreePort assigns an unused port to the clone instead of the port of
+// the cluster it was cloned from. Although clones listen on a unix socket in
+// their own data directory, the port is also used to derive the shared memory
+// keys used by postgres, so clones running in parallel should use distinct
+// ports. The port is written to the postgresql.conf of the clone and is
+// reflected by Port() and TestConnectString().
+func WithFreePort() CloneOption {
+	return func(o *cloneOptions) { o.freePort = true }
+}
+
+// Directories in which postgres commonly creates socket lock files.
+var socketLockDirs = []string{"/tmp", "/var/run/postgresql"}
+
+// How long a port handed out by freePort is not handed out again. This covers
+// the time between assigning a port and the server starting on it.
+const portReservation = time.Minute
+
+// The number of ports tried by freePort before giving up.
+const maxPortAttempts = 100
+
+var reservedPorts = struct {
+	sync.Mutex
+	at map[int]time.Time
+}{at: make(map[int]time.Time)}
+
+// freePort returns a port on which nothing listens on TCP and for which no
+// socket lock file exists in dirs or in the usual socket directories.
+func freePort(dirs ...string) (port int, err error) {
+	defer recoverFault(&err)
+	reservedPorts.Lock()
+	defer reservedPorts.Unlock()
+	for attempt := 0; attempt < maxPortAttempts; attempt++ {
+		listener := check.Return(net.Listen("tcp", "localhost:0")).(net.Listener)
+		port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		if at, found := reservedPorts.at[port]; found && time.Since(at) < portReservation {
+			continue
+		}
+		if portLocked(port, append(dirs, socketLockDirs...)) {
+			continue
+		}
+		reservedPorts.at[port] = time.Now()
+		return port, nil
+	}
+	return 0, errors.New("unable to find a free port")
+}
+
+func portLocked(port int, dirs []string) bool {
+	for _, dir := range dirs {
+		lockFile := filepath.Join(dir, fmt.Sprintf(".s.PGSQL.%d.lock", port))
+		if exists, err := surulio.Exists(lockFile); exists || err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setConfig sets the value of every occurrence of the config option key,
+// adding it if needed. Config is copied so that it is never shared with the
+// cluster this was cloned from.
+func (p *PostgresCluster) setConfig(key, value, comment string) {
+	config := make([]ConfigOpt, 0, len(p.Config)+1)
+	found := false
+	for _, opt := range p.Config {
+		if strings.EqualFold(opt.Key, key) {
+			opt.Value, found = value, true
+		}
+		config = append(config, opt)
+	}
+	if !found {
+		config = append(config, ConfigOpt{key, value, comment})
+	}
+	p.Config = config
+}
+
+// applyCloneOptions configures a newly copied clone.
+func (p *PostgresCluster) applyCloneOptions(o *cloneOptions) (err error) {
+	defer recoverFault(&err)
+	if !o.freePort && !o.ephemeral {
+		return
+	}
+	if o.freePort {
+		port := check.Return(freePort(p.DataDir)).(int)
+		p.setConfig("port", strconv.Itoa(port), "Free port assigned by ghostgres")
+	}
+	if o.ephemeral {
+		for _, opt := range ephemeralConfig {
+			p.setConfig(opt.Key, opt.Value, opt.Comment)
+		}
+	}
+	check.Error(surultpl.WriteFile(p.configFile(), postgresqlConfTemplate, p, 0600))
+	return
+}
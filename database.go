@@ -0,0 +1,151 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Postgres truncates identifiers longer than this.
+const maxIdentifierLength = 63
+
+var testDatabaseCount int64
+
+var nonIdentifierChars = regexp.MustCompile("[^a-z0-9_]+")
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// psql runs a single SQL statement against database using the psql binary
+// in BinDir and returns its output. It connects over the unix socket as the
+// current OS user, in the same manner as TestConnectString.
+func (p *PostgresCluster) psql(database, statement string) (output string, err error) {
+	return p.runPsql(context.Background(), database, nil, "-c", statement)
+}
+
+// psqlScript runs the SQL script read from script against database, stopping
+// at the first error.
+func (p *PostgresCluster) psqlScript(ctx context.Context, database string, script io.Reader) (output string, err error) {
+	return p.runPsql(ctx, database, script, "-f", "-")
+}
+
+func (p *PostgresCluster) runPsql(ctx context.Context, database string, stdin io.Reader, args ...string) (output string, err error) {
+	defer recoverFault(&err)
+	osUser := check.Return(user.Current()).(*user.User).Username
+	cmd := exec.CommandContext(ctx, filepath.Join(p.BinDir, "psql"), append([]string{
+		"-X", "-q", "-A", "-t",
+		"-v", "ON_ERROR_STOP=1",
+		"-h", check.Return(p.SocketDir()).(string),
+		"-p", strconv.Itoa(check.Return(p.Port()).(int)),
+		"-U", osUser,
+		"-d", database}, args...)...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+p.Password)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("psql failed: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// CreateDatabase creates the database name on a running cluster using
+// CREATE DATABASE ... TEMPLATE fromTemplate. Creating a database from a
+// template copies it at the file level which makes this a fast way to give
+// tests a fresh copy of a prepared database. If fromTemplate is empty
+// template1 is used. Please note that postgres does not allow anyone else
+// to be connected to fromTemplate while it is copied.
+func (p *PostgresCluster) CreateDatabase(name, fromTemplate string) (err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Running(), ErrNotRunning)
+	if fromTemplate == "" {
+		fromTemplate = "template1"
+	}
+	check.Return(p.psql("postgres", fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s",
+		quoteIdentifier(name), quoteIdentifier(fromTemplate))))
+	return
+}
+
+// DropDatabase terminates all connections to the database name on a running
+// cluster and drops it. It is not an error if the database does not exist.
+// New connections are refused while the database is dropped, using
+// DROP DATABASE ... WITH (FORCE) since postgres 13 and by disallowing
+// connections to it beforehand since 9.5.
+func (p *PostgresCluster) DropDatabase(name string) (err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Running(), ErrNotRunning)
+	version := p.serverVersion()
+	if version.AtLeast(13) {
+		check.Return(p.psql("postgres", fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", quoteIdentifier(name))))
+		return
+	}
+	exists := check.Return(p.psql("postgres", fmt.Sprintf(
+		"SELECT 1 FROM pg_database WHERE datname = %s", quoteLiteral(name)))).(string)
+	if strings.TrimSpace(exists) == "" {
+		return
+	}
+	if version.AtLeast(9, 5) {
+		check.Return(p.psql("postgres", fmt.Sprintf("ALTER DATABASE %s ALLOW_CONNECTIONS false", quoteIdentifier(name))))
+	}
+	check.Return(p.psql("postgres", fmt.Sprintf(
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = %s AND pid <> pg_backend_pid()",
+		quoteLiteral(name))))
+	check.Return(p.psql("postgres", fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(name))))
+	return
+}
+
+// testDatabaseName returns a unique database name derived from testName.
+func testDatabaseName(testName string) string {
+	suffix := fmt.Sprintf("_%d_%d", os.Getpid(), atomic.AddInt64(&testDatabaseCount, 1))
+	prefix := "test_" + strings.Trim(nonIdentifierChars.ReplaceAllString(strings.ToLower(testName), "_"), "_")
+	if len(prefix)+len(suffix) > maxIdentifierLength {
+		prefix = prefix[:maxIdentifierLength-len(suffix)]
+	}
+	return prefix + suffix
+}
+
+// NewTestDatabase creates a uniquely named database for the test t on a
+// running cluster by copying the database fromTemplate, as in CreateDatabase,
+// and returns its name. The database is dropped once the test completes.
+// This allows tests to share a single running cluster while remaining
+// isolated from each other.
+//
+//	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=%s", connStr, cluster.NewTestDatabase(t, "schema")))
+func (p *PostgresCluster) NewTestDatabase(t testing.TB, fromTemplate string) string {
+	t.Helper()
+	name := testDatabaseName(t.Name())
+	// Errors have already been reported if OnFailure is set.
+	if err := p.CreateDatabase(name, fromTemplate); err != nil {
+		if p.OnFailure == nil {
+			t.Fatal(err)
+		}
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		if err := p.DropDatabase(name); err != nil {
+			if p.OnFailure == nil {
+				t.Error(err)
+			}
+			t.Fail()
+		}
+	})
+	return name
+}
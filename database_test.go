@@ -0,0 +1,114 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openDatabase(c *C, cluster *PostgresCluster, database string) *sql.DB {
+	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=%s", testcheck.Return(cluster.TestConnectString()).(string), database))
+	c.Assert(err, IsNil)
+	return db
+}
+
+func (s *PostgresSuite) TestCreateDatabase(c *C) {
+	cluster := initdb(c)
+	c.Assert(errors.Is(cluster.CreateDatabase("fails", ""), ErrNotRunning), Equals, true)
+	c.Assert(cluster.Start(), IsNil)
+	defer cluster.Stop()
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+
+	c.Assert(cluster.CreateDatabase("schema", ""), IsNil)
+	schema := openDatabase(c, cluster, "schema")
+	_, err := schema.Exec("CREATE TABLE fixture (id int)")
+	c.Assert(err, IsNil)
+	c.Assert(schema.Close(), IsNil)
+
+	c.Assert(cluster.CreateDatabase(`my "copy"`, "schema"), IsNil)
+	db := openDatabase(c, cluster, `'my "copy"'`)
+	defer db.Close()
+	var count int
+	c.Assert(db.QueryRow("SELECT count(*) FROM fixture").Scan(&count), IsNil)
+
+	// Open connections must not prevent the database from being dropped.
+	c.Assert(cluster.DropDatabase(`my "copy"`), IsNil)
+	c.Assert(cluster.DropDatabase(`my "copy"`), IsNil)
+	c.Assert(cluster.CreateDatabase("other", "missing"), ErrorMatches, "(?s).*psql failed.*missing.*")
+}
+
+func (s *PostgresSuite) TestTestDatabaseName(c *C) {
+	name := testDatabaseName("TestSomething/sub-test #1")
+	c.Assert(name, Matches, "test_testsomething_sub_test_1_[0-9]+_[0-9]+")
+	c.Assert(testDatabaseName("TestSomething"), Not(Equals), testDatabaseName("TestSomething"))
+	c.Assert(len(testDatabaseName(strings.Repeat("x", 100))) <= maxIdentifierLength, Equals, true)
+}
+
+func TestNewTestDatabase(t *testing.T) {
+	cluster := &PostgresCluster{Config: TestConfig, DataDir: t.TempDir(), BinDir: *pgBinDir, OnFailure: t.Fatal}
+	cluster.Init()
+	cluster.Start()
+	defer cluster.Stop()
+	cluster.WaitTillServing(time.Second)
+
+	var name string
+	t.Run("isolated", func(t *testing.T) {
+		name = cluster.NewTestDatabase(t, "")
+		if !strings.HasPrefix(name, "test_testnewtestdatabase_isolated_") {
+			t.Fatalf("unexpected database name %s", name)
+		}
+	})
+	out, _ := cluster.psql("postgres", fmt.Sprintf("SELECT count(*) FROM pg_database WHERE datname = %s", quoteLiteral(name)))
+	if strings.TrimSpace(out) != "0" {
+		t.Fatalf("database %s was not dropped", name)
+	}
+}
+
+// recordingTB records the errors reported to it instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+	failed bool
+}
+
+func (r *recordingTB) Helper()      {}
+func (r *recordingTB) Name() string { return "TestRecording" }
+func (r *recordingTB) Fatal(args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprint(args...))
+	r.FailNow()
+}
+func (r *recordingTB) FailNow() {
+	r.failed = true
+	runtime.Goexit()
+}
+
+func TestNewTestDatabaseReportsOnce(t *testing.T) {
+	for _, handled := range []bool{false, true} {
+		handlerCalls := 0
+		cluster := &PostgresCluster{}
+		if handled {
+			cluster.OnFailure = func(...interface{}) { handlerCalls++ }
+		}
+		tb := &recordingTB{}
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			cluster.NewTestDatabase(tb, "")
+		}()
+		<-done
+		if !tb.failed {
+			t.Fatal("the test did not fail although the cluster is not running")
+		}
+		if reports := handlerCalls + len(tb.errors); reports != 1 {
+			t.Errorf("failure reported %d times with OnFailure set %v", reports, handled)
+		}
+	}
+}
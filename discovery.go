@@ -0,0 +1,172 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrPostgresNotFound is returned by FindPostgres if no installation matches.
+var ErrPostgresNotFound = errors.New("no matching postgres installation found")
+
+// Installation is a postgres installation found by DiscoverPostgres.
+type Installation struct {
+	// The directory containing the postgres binaries
+	BinDir string
+	// The version reported by postgres --version
+	Version Version
+}
+
+// Directories searched by DiscoverPostgres in addition to PATH and the
+// directory reported by pg_config. They may contain glob patterns.
+var postgresSearchDirs = []string{
+	"/usr/lib/postgresql/*/bin",
+	"/usr/pgsql-*/bin",
+	"/usr/local/pgsql/bin",
+	"/usr/local/opt/postgresql*/bin",
+	"/opt/homebrew/opt/postgresql*/bin",
+}
+
+var constraintVersion = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// inspectInstallation returns the installation in binDir or false if binDir
+// contains no working postgres binary.
+func inspectInstallation(binDir string) (Installation, bool) {
+	out, err := exec.Command(filepath.Join(binDir, "postgres"), "--version").Output()
+	if err != nil {
+		return Installation{}, false
+	}
+	version, err := ParseVersion(string(out))
+	if err != nil {
+		return Installation{}, false
+	}
+	return Installation{BinDir: binDir, Version: version}, true
+}
+
+// candidateBinDirs returns the directories which may contain postgres, in
+// order of preference.
+func candidateBinDirs() (dirs []string) {
+	if *pgBinDir != "" {
+		dirs = append(dirs, *pgBinDir)
+	}
+	if postgres, err := exec.LookPath("postgres"); err == nil {
+		dirs = append(dirs, filepath.Dir(postgres))
+	}
+	if out, err := exec.Command("pg_config", "--bindir").Output(); err == nil {
+		dirs = append(dirs, strings.TrimSpace(string(out)))
+	}
+	for _, pattern := range postgresSearchDirs {
+		matches, _ := filepath.Glob(pattern)
+		dirs = append(dirs, matches...)
+	}
+	return
+}
+
+// DiscoverPostgres finds the postgres installations on this machine sorted
+// from the newest to the oldest version. It searches the directory given by
+// the ghostgres_pg_bin_dir flag, PATH, the directory reported by
+// pg_config --bindir and common install locations such as
+// /usr/lib/postgresql/*/bin, /usr/pgsql-*/bin and /usr/local/pgsql/bin.
+func DiscoverPostgres() []Installation {
+	var installations []Installation
+	seen := make(map[string]bool)
+	for _, dir := range candidateBinDirs() {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil || seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		if info, err := os.Stat(filepath.Join(dir, "postgres")); err != nil || info.IsDir() {
+			continue
+		}
+		if installation, found := inspectInstallation(dir); found {
+			installations = append(installations, installation)
+		}
+	}
+	// A stable sort keeps the preferred directory first for equal versions.
+	sort.SliceStable(installations, func(i, j int) bool {
+		return installations[j].Version.Less(installations[i].Version)
+	})
+	return installations
+}
+
+// Matches reports whether the installation satisfies constraint. A
+// constraint is a version optionally preceded by one of the operators =, >,
+// >=, < or <=. Versions are compared using only as many components as the
+// constraint has, so 16 matches 16.2 and >=9.4 does not match 9.3.5. The
+// empty constraint and "latest" match every installation.
+func (i Installation) Matches(constraint string) (bool, error) {
+	op, want, err := parseConstraint(constraint)
+	if err != nil || want == "" {
+		return err == nil, err
+	}
+	var wanted []int
+	for _, part := range strings.Split(want, ".") {
+		n, _ := strconv.Atoi(part)
+		wanted = append(wanted, n)
+	}
+	have := i.Version.components()
+	if len(have) > len(wanted) {
+		have = have[:len(wanted)]
+	}
+	cmp := compareComponents(have, wanted)
+	switch op {
+	case "", "=":
+		return cmp == 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	}
+	return cmp <= 0, nil
+}
+
+// parseConstraint splits constraint into its operator and version. The
+// version is empty if the constraint matches every installation.
+func parseConstraint(constraint string) (op, version string, err error) {
+	constraint = strings.TrimSpace(constraint)
+	if constraint == "" || constraint == "latest" {
+		return "", "", nil
+	}
+	version = strings.TrimLeft(constraint, "<>=")
+	op = constraint[:len(constraint)-len(version)]
+	version = strings.TrimSpace(version)
+	switch op {
+	case "", "=", ">", ">=", "<", "<=":
+		if constraintVersion.MatchString(version) {
+			return op, version, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid postgres version constraint %q", constraint)
+}
+
+// FindPostgres returns the newest installation found by DiscoverPostgres
+// which satisfies constraint as described in Installation.Matches. Use
+// "latest" to pick the newest installation. An error wrapping
+// ErrPostgresNotFound is returned if none matches.
+//
+//	pg, err := ghostgres.FindPostgres(">=13")
+//	// Handle error
+//	cluster := &ghostgres.PostgresCluster{BinDir: pg.BinDir, ...}
+func FindPostgres(constraint string) (Installation, error) {
+	if _, _, err := parseConstraint(constraint); err != nil {
+		return Installation{}, err
+	}
+	for _, installation := range DiscoverPostgres() {
+		if matches, _ := installation.Matches(constraint); matches {
+			return installation, nil
+		}
+	}
+	return Installation{}, fmt.Errorf("%w: %q", ErrPostgresNotFound, constraint)
+}
@@ -0,0 +1,83 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"errors"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+func (s *PostgresSuite) TestInstallationMatches(c *C) {
+	old := Installation{Version: Version{Major: 9, Minor: 3, Patch: 5}}
+	modern := Installation{Version: Version{Major: 16, Minor: 2}}
+	for _, test := range []struct {
+		constraint  string
+		old, modern bool
+	}{
+		{"", true, true},
+		{"latest", true, true},
+		{"16", false, true},
+		{"= 9.3", true, false},
+		{"9.3.4", false, false},
+		{">=9.4", false, true},
+		{">9", false, true},
+		{"<16", true, false},
+		{"<=16.2", true, true},
+	} {
+		matches, err := old.Matches(test.constraint)
+		c.Assert(err, IsNil)
+		c.Assert(matches, Equals, test.old, Commentf("%s", test.constraint))
+		matches, err = modern.Matches(test.constraint)
+		c.Assert(err, IsNil)
+		c.Assert(matches, Equals, test.modern, Commentf("%s", test.constraint))
+	}
+	for _, invalid := range []string{"newest", "=>9", "~16", "16.x"} {
+		_, err := old.Matches(invalid)
+		c.Assert(err, ErrorMatches, "invalid postgres version constraint.*")
+	}
+}
+
+func (s *PostgresSuite) TestDiscoverPostgres(c *C) {
+	oldDirs, oldPath, oldBinDir := postgresSearchDirs, os.Getenv("PATH"), *pgBinDir
+	defer func() {
+		postgresSearchDirs, *pgBinDir = oldDirs, oldBinDir
+		os.Setenv("PATH", oldPath)
+	}()
+	root := c.MkDir()
+	for version, dir := range map[string]string{
+		"9.3.5": "9.3", "16.2 (Debian 16.2-1.pgdg120+2)": "16", "12.1": "12", "18beta1": "18",
+	} {
+		c.Assert(os.MkdirAll(filepath.Join(root, dir), 0700), IsNil)
+		c.Assert(os.Rename(fakeBinDir(c, version), filepath.Join(root, dir, "bin")), IsNil)
+	}
+	c.Assert(os.MkdirAll(filepath.Join(root, "empty", "bin"), 0700), IsNil)
+	postgresSearchDirs = []string{filepath.Join(root, "*", "bin")}
+	*pgBinDir = ""
+	// The installation in PATH is only listed once.
+	os.Setenv("PATH", filepath.Join(root, "12", "bin"))
+
+	installations := DiscoverPostgres()
+	c.Assert(installations, DeepEquals, []Installation{
+		{filepath.Join(root, "18", "bin"), Version{Major: 18, Pre: "beta1"}},
+		{filepath.Join(root, "16", "bin"), Version{Major: 16, Minor: 2}},
+		{filepath.Join(root, "12", "bin"), Version{Major: 12, Minor: 1}},
+		{filepath.Join(root, "9.3", "bin"), Version{Major: 9, Minor: 3, Patch: 5}},
+	})
+
+	latest, err := FindPostgres("latest")
+	c.Assert(err, IsNil)
+	c.Assert(latest.Version.String(), Equals, "18beta1")
+	stable, err := FindPostgres("<18")
+	c.Assert(err, IsNil)
+	c.Assert(stable.Version.String(), Equals, "16.2")
+	older, err := FindPostgres("<16")
+	c.Assert(err, IsNil)
+	c.Assert(older.Version.String(), Equals, "12.1")
+	_, err = FindPostgres("17")
+	c.Assert(errors.Is(err, ErrPostgresNotFound), Equals, true)
+	_, err = FindPostgres("newest")
+	c.Assert(err, ErrorMatches, "invalid postgres version constraint.*")
+}
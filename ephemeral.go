@@ -0,0 +1,74 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WithEphemeral creates a throwaway clone which trades durability for speed.
+// fsync, synchronous_commit and full_page_writes are turned off for the clone
+// and, if FromTemplate is called with an empty dest, the temporary directory
+// holding the clone is created on a memory backed tmpfs such as /dev/shm so
+// that neither cloning nor WAL writes touch the disk. The tmpfs is only used
+// if both it and the available memory have room for the template plus
+// ephemeralHeadroom. Otherwise the clone falls back to the usual temporary
+// directory. CloneStats reports whether the clone was placed on a tmpfs.
+func WithEphemeral() CloneOption {
+	return func(o *cloneOptions) { o.ephemeral = true }
+}
+
+// Directories on which ephemeral clones are placed, in order of preference.
+var tmpfsDirs = []string{"/dev/shm"}
+
+// The space needed by an ephemeral clone in addition to the size of its
+// template. This leaves room for WAL segments and for tables to grow.
+const ephemeralHeadroom = 256 << 20
+
+// Settings which make postgres skip work that is only needed to survive a
+// crash.
+var ephemeralConfig = []ConfigOpt{
+	{"fsync", "off", "Ephemeral clone"},
+	{"synchronous_commit", "off", "Ephemeral clone"},
+	{"full_page_writes", "off", "Ephemeral clone"},
+}
+
+// tmpfsDir returns the first directory in tmpfsDirs which is a tmpfs with
+// room for size bytes plus ephemeralHeadroom or "" if there is none.
+func tmpfsDir(size int64) string {
+	needed := uint64(size) + ephemeralHeadroom
+	memory, memoryKnown := availableMemory()
+	if memoryKnown && memory < needed {
+		return ""
+	}
+	for _, dir := range tmpfsDirs {
+		if free, isTmpfs := tmpfsFree(dir); isTmpfs && free >= needed {
+			return dir
+		}
+	}
+	return ""
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	return
+}
+
+// ephemeralTempDir returns the directory in which to create the temporary
+// directory of an ephemeral clone of the data directory src. It returns ""
+// if the clone should be placed in the default temporary directory.
+func ephemeralTempDir(src string) string {
+	size, err := dirSize(src)
+	if err != nil {
+		return ""
+	}
+	return tmpfsDir(size)
+}
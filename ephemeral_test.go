@@ -0,0 +1,46 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (s *PostgresSuite) TestTmpfsDir(c *C) {
+	oldDirs := tmpfsDirs
+	defer func() { tmpfsDirs = oldDirs }()
+
+	tmpfsDirs = []string{filepath.Join(c.MkDir(), "missing")}
+	c.Assert(tmpfsDir(0), Equals, "")
+	tmpfsDirs = []string{"/dev/shm"}
+	if _, isTmpfs := tmpfsFree("/dev/shm"); !isTmpfs {
+		c.Skip("/dev/shm is not a tmpfs")
+	}
+	c.Assert(tmpfsDir(0), Equals, "/dev/shm")
+	// Fall back to disk if the template does not fit.
+	c.Assert(tmpfsDir(1<<62), Equals, "")
+}
+
+func (s *PostgresSuite) TestEphemeralClone(c *C) {
+	freezeDir := c.MkDir()
+	c.Assert(initdb(c).Freeze(freezeDir, "ephemeral"), IsNil)
+	cloned, err := FromTemplate(freezeDir, "ephemeral", "", WithEphemeral())
+	c.Assert(err, IsNil)
+	conf, err := ioutil.ReadFile(cloned.configFile())
+	c.Assert(err, IsNil)
+	c.Assert(string(conf), Matches, "(?s).*\nfsync = off .*")
+	if cloned.CloneStats().Tmpfs {
+		c.Assert(strings.HasPrefix(cloned.DataDir, tmpfsDirs[0]), Equals, true)
+	}
+	c.Assert(cloned.Start(), IsNil)
+	c.Assert(cloned.WaitTillServing(time.Second), IsNil)
+	c.Assert(cloned.Stop(), IsNil)
+	_, err = os.Stat(cloned.DataDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,104 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"errors"
+	"fmt"
+	"github.com/surullabs/fault"
+	"strings"
+	"syscall"
+)
+
+// Errors returned by PostgresCluster. They may be wrapped with additional
+// context so use errors.Is to check for them.
+var (
+	ErrAlreadyInitialized = errors.New("postgres cluster already initialized")
+	ErrNotInitialized     = errors.New("postgres cluster not initialized")
+	ErrAlreadyRunning     = errors.New("postgres cluster already running")
+	ErrNotRunning         = errors.New("postgres cluster not running")
+	ErrDestExists         = errors.New("cannot clone into an existing directory")
+	ErrTemplateExists     = errors.New("template already exists")
+	ErrTemplateInvalid    = errors.New("template is invalid")
+)
+
+// InitdbError is returned when initdb fails.
+type InitdbError struct {
+	// The combined stdout and stderr of initdb
+	Output string
+	// The error returned when running initdb
+	Err error
+}
+
+func (e *InitdbError) Error() string {
+	return fmt.Sprintf("initdb failed: %v\n%s", e.Err, strings.TrimSpace(e.Output))
+}
+
+func (e *InitdbError) Unwrap() error { return e.Err }
+
+// ExitError is returned when the postgres server exits unsuccessfully.
+type ExitError struct {
+	// The exit code of the server or -1 if it was terminated by a signal
+	Code int
+	// The signal that terminated the server or 0 if it exited normally
+	Signal syscall.Signal
+	// The most recent output of the server
+	Output []LogLine
+	// The error returned when waiting for the server process
+	Err error
+}
+
+func (e *ExitError) Error() string { return withOutputText(e.Err, e.Output) }
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+func withOutputText(err error, output []LogLine) string {
+	if len(output) == 0 {
+		return err.Error()
+	}
+	lines := make([]string, len(output))
+	for i, line := range output {
+		lines[i] = line.Text
+	}
+	return fmt.Sprintf("%s\nserver output:\n%s", err, strings.Join(lines, "\n"))
+}
+
+// handleFailure passes *errp to OnFailure if it is set. Since exported methods
+// call each other an error which wraps one that has already been reported is
+// not passed on again.
+func (p *PostgresCluster) handleFailure(errp *error) {
+	if *errp == nil || p.OnFailure == nil {
+		return
+	}
+	if p.reported != nil && errors.Is(*errp, p.reported) {
+		return
+	}
+	p.reported = *errp
+	p.OnFailure(*errp)
+}
+
+// requireTrue raises err as a fault if cond is false.
+func requireTrue(cond bool, err error) {
+	if !cond {
+		check.Error(err)
+	}
+}
+
+// causeError is a fault which unwraps to its cause.
+type causeError struct{ fault.Fault }
+
+func (e *causeError) Unwrap() error { return e.Cause() }
+
+// recoverFault is used in place of check.Recover. The errors it returns
+// unwrap to the cause of the fault so that callers can inspect errors
+// returned by this package using errors.Is and errors.As.
+func recoverFault(errp *error) {
+	if e := recover(); e != nil {
+		f, isFault := e.(fault.Fault)
+		if !isFault {
+			panic(e)
+		}
+		*errp = &causeError{f}
+	}
+}
@@ -15,6 +15,9 @@ run
 	// as a template for future clusters.
 	go test github.com/surullabs/ghostgres --ghostgres_pg_bin_dir=<path_to_your_postgres_bin_dir>
 
+The template is stored in the directory returned by TemplateStore.
+Alternatively use EnsureTemplate to create a template on first use.
+
 In your test code you can now use (with appropriate error checks)
 
 	// Create a cloned cluster from the default template in a temporary directory
@@ -32,21 +35,32 @@ In your test code you can now use (with appropriate error checks)
 	connStr, err = cluster.TestConnectString() // Handle error
 	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=postgres", connStr))
 
+The error checks can be skipped by setting a FailureHandler. ForTest does this
+for you using testing.TB.Fatal
+
+	cluster := ghostgres.ForTest(t)
+	cluster.Start()
+	defer cluster.Stop()
+	connStr, _ := cluster.TestConnectString()
+
 Please consult the examples for other sample usage.
 */
 package ghostgres
 
 import (
+	"context"
 	"fmt"
 	"github.com/surullabs/fault"
 	surulio "github.com/surullabs/goutil/io"
 	surultpl "github.com/surullabs/goutil/template"
+	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
-	"syscall"
+	"strings"
 	"text/template"
 	"time"
 )
@@ -68,7 +82,8 @@ type ConfigOpt struct {
 }
 
 // FailureHandler defines a function to be called when errors occur. Setting one
-// makes using PostgresCluster easier in tests.
+// makes using PostgresCluster easier in tests. log.Fatal and testing.TB.Fatal
+// are both valid handlers.
 type FailureHandler func(...interface{})
 
 // TestLogFileName is the file name to which PostgresSQL will
@@ -97,7 +112,8 @@ var LoggingConfig = []ConfigOpt{
 // TestConnectString returns a connect string to use when using
 // TestConfig or an error if unable to build the string.
 func (p *PostgresCluster) TestConnectString() (str string, err error) {
-	defer check.Recover(&err)
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
 	osUser := check.Return(user.Current()).(*user.User).Username
 	return fmt.Sprintf("sslmode=disable host=%s port=%d user=%s",
 		check.Return(p.SocketDir()), check.Return(p.Port()).(int), osUser), nil
@@ -126,8 +142,22 @@ type PostgresCluster struct {
 	BinDir string
 	// The password for the super user
 	Password string
-	// The running postgres process
-	proc *exec.Cmd
+	// If not nil every error returned by an exported method is also passed to
+	// OnFailure. Clones inherit the handler of the cluster they are cloned from.
+	OnFailure FailureHandler `json:"-"`
+	// If not nil output written by the postgres server to stdout and stderr
+	// is copied to LogWriter in addition to being available from Logs().
+	LogWriter io.Writer `json:"-"`
+	// The supervised postgres process, if the server has been started
+	proc *process
+	// Output captured from the postgres server
+	logs *logBuffer
+	// The last error passed to OnFailure
+	reported error
+	// How the cluster was cloned
+	cloneStats CloneStats
+	// The encoding and locale chosen by initdb, if known. Clones inherit it.
+	locale initLocale
 	// If not nil this handler is run after the database is stopped
 	onStop func()
 }
@@ -161,26 +191,71 @@ var tempDir = &surulio.SafeTempDirExecer{}
 // only call Start() on the clone. This allows a single golden copy
 // to be shared among multiple tests with fast start times.
 func (p *PostgresCluster) Init() (err error) {
-	defer check.Recover(&err)
+	return p.InitContext(context.Background())
+}
 
-	check.True(!p.Initialized(), "postgres cluster already initialized")
+// InitContext is like Init but runs initdb bound to ctx. If ctx is done
+// before initialization completes initdb is killed and the partially
+// initialized data directory is removed.
+func (p *PostgresCluster) InitContext(ctx context.Context) (err error) {
+	defer p.handleFailure(&err)
+	var cleanup func()
+	defer func() {
+		if err != nil && ctx.Err() != nil && cleanup != nil {
+			cleanup()
+		}
+	}()
+	defer recoverFault(&err)
+
+	requireTrue(!p.Initialized(), ErrAlreadyInitialized)
+	if existed, empty := dirState(p.DataDir); empty {
+		cleanup = func() { removePartial(p.DataDir, existed) }
+	}
 	args := make([]ConfigOpt, len(p.InitOpts))
 	copy(args, p.InitOpts)
 	args = append(args, ConfigOpt{"--pgdata", p.DataDir, ""})
 
+	var output []byte
 	check.Error(tempDir.Exec("pg_init", func(dir string) error {
 		passwordFile := filepath.Join(dir, "postgres_pass")
 		check.Error(ioutil.WriteFile(passwordFile, []byte(p.Password), 0600))
 
 		args = append(args, ConfigOpt{"--pwfile", passwordFile, ""})
-		initdb := exec.Command(filepath.Join(p.BinDir, "initdb"), makeArgs(args)...)
-		check.Output(initdb.CombinedOutput())
+		initdb := exec.CommandContext(ctx, filepath.Join(p.BinDir, "initdb"), makeArgs(args)...)
+		out, err := initdb.CombinedOutput()
+		if err != nil {
+			check.Error(&InitdbError{Output: string(out), Err: err})
+		}
+		output = out
 		return nil
 	}))
+	// Record the locale initdb chose so that templates can report it.
+	p.locale = parseInitLocale(string(output), p.InitOpts)
 	// Now write out the postgresql.conf
 	return surultpl.WriteFile(p.configFile(), postgresqlConfTemplate, p, 0600)
 }
 
+// dirState reports whether dir exists and whether it is empty or missing.
+func dirState(dir string) (exists, empty bool) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, true
+	}
+	return err == nil, err == nil && len(entries) == 0
+}
+
+// removePartial removes dir if it did not exist before or only its contents otherwise.
+func removePartial(dir string, existed bool) {
+	if !existed {
+		os.RemoveAll(dir)
+		return
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		os.RemoveAll(filepath.Join(dir, entry.Name()))
+	}
+}
+
 // InitIfNeeded calls Init() if a call to Initialized returns false.
 func (p *PostgresCluster) InitIfNeeded() (err error) {
 	if !p.Initialized() {
@@ -194,25 +269,36 @@ func (p *PostgresCluster) configFile() string { return filepath.Join(p.DataDir,
 // Port attempts to parse a port from the provided config options
 // and returns the parsed port or an error if no port could be parsed..
 func (p *PostgresCluster) Port() (portVal int, err error) {
-	port := "5432"
-	for _, opt := range p.Config {
-		if opt.Key == "port" {
-			port = opt.Value
-			break
-		}
+	defer p.handleFailure(&err)
+	port, found := p.configValue("port")
+	if !found {
+		port = "5432"
 	}
 	return strconv.Atoi(port)
 }
 
+// configValue returns the value of the config option with the given key. As
+// in postgresql.conf keys are case insensitive and the last occurrence wins.
+func (p *PostgresCluster) configValue(key string) (value string, found bool) {
+	for i := len(p.Config) - 1; i >= 0; i-- {
+		if strings.EqualFold(p.Config[i].Key, key) {
+			return p.Config[i].Value, true
+		}
+	}
+	return "", false
+}
+
 // SocketDir returns the location of the postgres unix socket directory.
 // Note: This will panic if it is unable to find the absolute path to the socket directory.
 func (p *PostgresCluster) SocketDir() (str string, err error) {
+	defer p.handleFailure(&err)
 	return filepath.Abs(p.DataDir)
 }
 
 // SocketFile returns the location of the postgres socket file
 func (p *PostgresCluster) SocketFile() (socketFile string, err error) {
-	defer check.Recover(&err)
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
 	return filepath.Join(
 		check.Return(p.SocketDir()).(string),
 		fmt.Sprintf(".s.PGSQL.%d", check.Return(p.Port()).(int))), nil
@@ -230,20 +316,50 @@ func (p *PostgresCluster) Initialized() bool {
 
 // WaitTillServing waits for a duration of timeout for the postgres server to start.
 // It must be called after a call to Start() and before a call to Stop() or Wait()
-// It polls for the existence of the socket file every 10ms to detect if the server
-// is running and accessible and will return an error if it cannot detect the
-// server within timeout.
+// It attempts a protocol level startup handshake with the server every 10ms, over
+// TCP if listen_addresses is set and over the unix socket otherwise. A server that
+// is still starting up or recovering is not considered to be serving. It will return
+// an error, including the last error reported while connecting, if the server is not
+// serving within timeout. It returns immediately if the server exits while waiting.
 func (p *PostgresCluster) WaitTillServing(timeout time.Duration) (err error) {
-	defer check.Recover(&err)
-	check.True(p.Running(), "server has not been started")
-	return surulio.WaitTillExists(check.Return(p.SocketFile()).(string), 10*time.Millisecond, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.WaitTillServingContext(ctx)
+}
+
+// WaitTillServingContext is like WaitTillServing but waits until ctx is done
+// instead of for a fixed timeout.
+func (p *PostgresCluster) WaitTillServingContext(ctx context.Context) (err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Running(), fmt.Errorf("server has not been started: %w", ErrNotRunning))
+	network, address, err := p.serverAddress()
+	check.Error(err)
+	osUser := check.Return(user.Current()).(*user.User).Username
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		lastErr := ping(ctx, network, address, osUser)
+		if lastErr == nil {
+			p.proc.transition(Starting, Serving)
+			return nil
+		}
+		select {
+		case <-p.Done():
+			return fmt.Errorf("server exited before serving (last error: %v): %w", lastErr, p.ExitErr())
+		case <-ctx.Done():
+			return p.proc.withOutput(fmt.Errorf("server not serving: %v (last error: %v)", ctx.Err(), lastErr))
+		case <-ticker.C:
+		}
+	}
 }
 
-// Running will return true if the server is running. Please note that this is still
-// not very accurate as it merely checks if the server has been started.
+// Running will return true if the server process has been started and has not
+// yet exited. The process is supervised in a separate goroutine so this will
+// return false as soon as the server exits, even if Wait has not been called.
 func (p *PostgresCluster) Running() bool {
-	// TODO: Run the process in a separate goroutine and make this more robust.
-	return p.proc != nil
+	return p.State().alive()
 }
 
 // Start starts the postgres database. It will add the following extra flags in addition
@@ -256,9 +372,21 @@ func (p *PostgresCluster) Running() bool {
 // It does not attempt to read the config file to determine the data directory or the
 // socket directory.
 func (p *PostgresCluster) Start() (err error) {
-	defer check.Recover(&err)
-	check.True(p.Initialized(), "postgres cluster not initialized")
-	check.True(!p.Running(), "postgres cluster already running")
+	return p.StartContext(context.Background())
+}
+
+// The time allowed for a server to exit after an immediate shutdown caused by
+// the context passed to StartContext before it is killed.
+const cancelKillDelay = 5 * time.Second
+
+// StartContext is like Start but binds the lifetime of the server to ctx. If
+// ctx is done before the server exits, it is shut down in Immediate mode and
+// killed if it has not exited within 5 seconds.
+func (p *PostgresCluster) StartContext(ctx context.Context) (err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Initialized(), ErrNotInitialized)
+	requireTrue(!p.Running(), ErrAlreadyRunning)
 
 	args := make([]ConfigOpt, len(p.RunOpts))
 	copy(args, p.RunOpts)
@@ -266,23 +394,56 @@ func (p *PostgresCluster) Start() (err error) {
 	args = append(args, ConfigOpt{"-D", socketDir, ""})
 	args = append(args, ConfigOpt{"-k", socketDir, ""})
 	args = append(args, ConfigOpt{"-c", fmt.Sprintf("config_file=%s", p.configFile()), ""})
-	proc := exec.Command(filepath.Join(p.BinDir, "postgres"), makeArgs(args)...)
+	proc := exec.CommandContext(ctx, filepath.Join(p.BinDir, "postgres"), makeArgs(args)...)
+	proc.Cancel = func() error { return proc.Process.Signal(Immediate.signal()) }
+	proc.WaitDelay = cancelKillDelay
+	if p.logs == nil {
+		p.logs = newLogBuffer()
+	}
+	proc.Stdout = p.logs.writer("stdout", p.LogWriter)
+	proc.Stderr = p.logs.writer("stderr", p.LogWriter)
+	logStart := p.logs.mark()
 	check.Error(proc.Start())
-	p.proc = proc
+	p.proc = supervise(ctx, proc, p.Config, p.logs, logStart)
 	return
 }
 
-// Clone clones a previous postgres database by copying the entire directory
-// This currently only works on systems which have a cp command. This
-// will not work if the destination directory exists.
-func (p *PostgresCluster) Clone(dest string) (c *PostgresCluster, err error) {
-	defer check.Recover(&err)
-	check.True(!p.Running(), "cannot clone a running cluster")
-	check.True(p.Initialized(), "cluster must be initialized before cloning")
-	check.True(!check.Return(surulio.Exists(dest)).(bool), "cannot clone into an existing directory")
-	check.Output(exec.Command("cp", "-r", p.DataDir, dest).CombinedOutput())
+// Clone clones a previous postgres database by copying the entire directory.
+// This will not work if the destination directory exists. The clone can be
+// configured using opts. The directory is copied using the strategy returned
+// by DetectCloneStrategy unless one is passed using WithCloneStrategy.
+func (p *PostgresCluster) Clone(dest string, opts ...CloneOption) (c *PostgresCluster, err error) {
+	return p.CloneContext(context.Background(), dest, opts...)
+}
+
+// CloneContext is like Clone but runs the copy bound to ctx. A partial copy
+// is removed if the copy fails or ctx is done before it completes.
+func (p *PostgresCluster) CloneContext(ctx context.Context, dest string, opts ...CloneOption) (c *PostgresCluster, err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(!p.Running(), fmt.Errorf("cannot clone a running cluster: %w", ErrAlreadyRunning))
+	requireTrue(p.Initialized(), fmt.Errorf("cluster must be initialized before cloning: %w", ErrNotInitialized))
+	requireTrue(!check.Return(surulio.Exists(dest)).(bool), ErrDestExists)
+	o := newCloneOptions(opts)
+	strategy := o.strategy
+	if strategy == nil {
+		strategy = DetectCloneStrategy(p.DataDir, filepath.Dir(dest))
+	}
+	start := time.Now()
+	if err := strategy.Copy(ctx, p.DataDir, dest); err != nil {
+		os.RemoveAll(dest)
+		check.Error(err)
+	}
 	cloned := *p
+	cloned.cloneStats = CloneStats{Strategy: strategy.Name(), Duration: time.Since(start)}
 	cloned.DataDir = dest
+	cloned.proc = nil
+	cloned.logs = nil
+	cloned.reported = nil
+	if err := cloned.applyCloneOptions(o); err != nil {
+		os.RemoveAll(dest)
+		check.Error(err)
+	}
 	return &cloned, nil
 }
 
@@ -292,30 +453,88 @@ func (p *PostgresCluster) Clone(dest string) (c *PostgresCluster, err error) {
 //	pg_ctl -D p.DataDir stop
 //
 // It will return an error if the server exits with any return code other than 0 or as a result of SIGTERM.
-// It is an error to call this before calling Start.
+// It is an error to call this before calling Start or after the exit status has
+// already been returned by Wait or Stop.
 func (p *PostgresCluster) Wait() (err error) {
-	defer check.Recover(&err)
-	check.True(p.Running(), "postgres cluster not running")
-	defer func() { p.proc = nil }()
-	if err = p.proc.Wait(); err != nil && err.Error() == "signal: terminated" {
-		err = nil
-	}
-	return
+	defer p.handleFailure(&err)
+	return p.wait()
+}
+
+func (p *PostgresCluster) wait() (err error) {
+	defer recoverFault(&err)
+	requireTrue(p.proc != nil && !p.proc.consumed(), ErrNotRunning)
+	<-p.proc.done
+	// Only one of several concurrent callers receives the exit status.
+	requireTrue(p.proc.consume(), ErrNotRunning)
+	return p.ExitErr()
 }
 
 // Stop stops the postgres cluster if it is running by sending it a SIGTERM signal.
 // This will request a slow shutdown and the postgres server will wait for all existing
-// connections to close. It is an error to call this if the server is not running.
+// connections to close. If the server has already exited on its own the exit error
+// is returned. Calling Stop on a cluster that is not running is a no-op.
+// It is equivalent to StopWithMode(Smart, 0).
 func (p *PostgresCluster) Stop() (err error) {
-	defer check.Recover(&err)
+	_, err = p.StopWithMode(Smart, 0)
+	return
+}
+
+// StopContext is like Stop but kills the server if it has not exited by
+// the time ctx is done. It is equivalent to StopWithModeContext(ctx, Smart, 0).
+func (p *PostgresCluster) StopContext(ctx context.Context) (err error) {
+	_, err = p.StopWithModeContext(ctx, Smart, 0)
+	return
+}
+
+// StopWithMode stops the postgres cluster using the given shutdown mode. If the
+// server has not exited within timeout the next, more forceful, mode is used
+// escalating from Smart to Fast to Immediate and finally to Kill. The mode
+// that was needed to stop the server is returned. A timeout <= 0 waits
+// indefinitely for the requested mode to succeed.
+//
+// An exit caused by one of the signals sent by StopWithMode is not treated
+// as an error. The cleanup registered by FromTemplate is always run.
+func (p *PostgresCluster) StopWithMode(mode ShutdownMode, timeout time.Duration) (used ShutdownMode, err error) {
+	return p.StopWithModeContext(context.Background(), mode, timeout)
+}
+
+// StopWithModeContext is like StopWithMode but escalates directly to Kill
+// if the server has not exited by the time ctx is done.
+func (p *PostgresCluster) StopWithModeContext(ctx context.Context, mode ShutdownMode, timeout time.Duration) (used ShutdownMode, err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
 	defer func() {
 		if p.onStop != nil {
 			p.onStop()
 		}
 	}()
-	if !p.Running() {
+	check.True(mode >= Smart && mode <= Kill, fmt.Sprintf("invalid shutdown mode %d", mode))
+	used = mode
+	if p.proc == nil || p.proc.consumed() {
 		return
 	}
-	p.proc.Process.Signal(syscall.SIGTERM)
-	return p.Wait()
+	signalled := p.Running()
+	if signalled {
+		p.proc.stopping()
+		for {
+			p.proc.Process.Signal(used.signal())
+			if used == Kill || p.proc.waitFor(ctx, timeout) {
+				break
+			}
+			if ctx.Err() != nil {
+				used = Kill
+			} else {
+				used++
+			}
+		}
+	}
+	if err = p.wait(); err != nil && signalled {
+		sig := p.proc.exitSignal()
+		for sent := mode; sent <= used; sent++ {
+			if sig == sent.signal() {
+				return used, nil
+			}
+		}
+	}
+	return
 }
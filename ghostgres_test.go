@@ -4,17 +4,23 @@
 package ghostgres
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
 	"github.com/surullabs/fault"
 	. "github.com/surullabs/goutil/testing"
+	"io"
 	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"testing"
 	"time"
@@ -104,6 +110,19 @@ func initdb(c *C) *PostgresCluster {
 	return cluster
 }
 
+func (s *PostgresSuite) TestDuplicateSettings(c *C) {
+	// The last occurrence of a setting wins as in postgresql.conf.
+	cluster := &PostgresCluster{Config: []ConfigOpt{{"port", "5432", ""}, {"Port", "5433", ""}}}
+	c.Assert(testcheck.Return(cluster.Port()).(int), Equals, 5433)
+	before := []ConfigOpt{{"shared_buffers", "10MB", ""}, {"work_mem", "4MB", ""}}
+	after := []ConfigOpt{{"shared_buffers", "10MB", ""}, {"work_mem", "4MB", ""}, {"shared_buffers", "20MB", ""}}
+	c.Assert(changedSettings(before, after), DeepEquals, []string{"shared_buffers"})
+	c.Assert(changedSettings(after, append(after, ConfigOpt{"SHARED_BUFFERS", "20MB", ""})), HasLen, 0)
+	cluster.setConfig("port", "6000", "")
+	c.Assert(testcheck.Return(cluster.Port()).(int), Equals, 6000)
+	c.Assert(cluster.Config, HasLen, 2)
+}
+
 func (s *PostgresSuite) TestBadPort(c *C) {
 	cluster := testCluster(c)
 	cluster.Config = []ConfigOpt{{"port", "this is a bad port", ""}}
@@ -124,6 +143,225 @@ func (s *PostgresSuite) TestStopTerminated(c *C) {
 	c.Assert(cluster.Stop(), IsNil)
 }
 
+func (s *PostgresSuite) TestSupervision(c *C) {
+	cluster := initdb(c)
+	c.Assert(cluster.State(), Equals, NotStarted)
+	c.Assert(cluster.Done(), IsNil)
+
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(cluster.Running(), Equals, true)
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+	c.Assert(cluster.State(), Equals, Serving)
+	c.Assert(cluster.Stop(), IsNil)
+	c.Assert(cluster.State(), Equals, Exited)
+	c.Assert(cluster.ExitErr(), IsNil)
+
+	// A server that fails to start must be detected without calling Wait.
+	cluster.RunOpts = []ConfigOpt{{Key: "--fake_flag"}}
+	c.Assert(cluster.Start(), IsNil)
+	select {
+	case <-cluster.Done():
+	case <-time.After(5 * time.Second):
+		c.Fatal("server did not exit")
+	}
+	c.Assert(cluster.Running(), Equals, false)
+	c.Assert(cluster.State(), Equals, Crashed)
+	c.Assert(cluster.ExitErr(), ErrorMatches, "(?s)exit status 1\nserver output:\n.*fake_flag.*")
+	c.Assert(cluster.Wait(), ErrorMatches, "(?s)exit status 1\nserver output:\n.*fake_flag.*")
+	c.Assert(cluster.Stop(), IsNil)
+}
+
+func (s *PostgresSuite) TestLogs(c *C) {
+	cluster := initdb(c)
+	c.Assert(cluster.Logs(), IsNil)
+	var sink bytes.Buffer
+	cluster.LogWriter = &sink
+	cluster.RunOpts = []ConfigOpt{{Key: "--fake_flag"}}
+	c.Assert(cluster.Start(), IsNil)
+	<-cluster.Done()
+	c.Assert(cluster.Wait(), NotNil)
+
+	logs := cluster.Logs()
+	c.Assert(len(logs) > 0, Equals, true)
+	c.Assert(logs[0].Stream, Equals, "stderr")
+	c.Assert(logs[0].Text, Matches, ".*fake_flag.*")
+	c.Assert(sink.String(), Matches, "(?s).*fake_flag.*")
+}
+
+func (s *PostgresSuite) TestConcurrentWait(c *C) {
+	cmd := exec.Command("true")
+	c.Assert(cmd.Start(), IsNil)
+	cluster := &PostgresCluster{proc: supervise(context.Background(), cmd, nil, nil, 0)}
+	const waiters = 4
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() { errs <- cluster.Wait() }()
+	}
+	consumed := 0
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err == nil {
+			consumed++
+		} else {
+			c.Assert(errors.Is(err, ErrNotRunning), Equals, true)
+		}
+	}
+	// Only one caller receives the exit status.
+	c.Assert(consumed, Equals, 1)
+	_, err := cluster.StopWithMode(Fast, 0)
+	c.Assert(err, IsNil)
+}
+
+func (s *PostgresSuite) TestLogBuffer(c *C) {
+	buf := newLogBuffer()
+	w := buf.writer("stdout", nil)
+	for i := 0; i < maxLogLines+10; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	fmt.Fprint(w, "partial")
+	mark := buf.mark()
+	c.Assert(buf.since(mark, -1), HasLen, 0)
+	buf.flush()
+
+	lines := buf.since(0, -1)
+	c.Assert(lines, HasLen, maxLogLines)
+	c.Assert(lines[0].Text, Equals, "line 11")
+	c.Assert(lines[len(lines)-1].Text, Equals, "partial")
+	tail := buf.since(mark, 5)
+	c.Assert(tail, HasLen, 1)
+	c.Assert(tail[0].Text, Equals, "partial")
+	c.Assert(buf.since(0, 2)[0].Text, Equals, fmt.Sprintf("line %d", maxLogLines+9))
+}
+
+// countingSink counts the bytes written to it. It yields between reading
+// and updating the count so that unserialized writes lose updates.
+type countingSink struct{ n int }
+
+func (s *countingSink) Write(data []byte) (int, error) {
+	n := s.n
+	runtime.Gosched()
+	s.n = n + len(data)
+	return len(data), nil
+}
+
+func (s *PostgresSuite) TestLogBufferConcurrentSink(c *C) {
+	// The stdout and stderr writers share a sink which must not be written
+	// concurrently. This also fails under -race otherwise.
+	sink := &countingSink{}
+	buf := newLogBuffer()
+	const writes = maxLogLines / 2
+	start, done := make(chan bool), make(chan bool)
+	for _, stream := range []string{"stdout", "stderr"} {
+		go func(w io.Writer) {
+			<-start
+			for i := 0; i < writes; i++ {
+				w.Write([]byte("line\n"))
+			}
+			done <- true
+		}(buf.writer(stream, sink))
+	}
+	close(start)
+	<-done
+	<-done
+	c.Assert(buf.since(0, -1), HasLen, 2*writes)
+	c.Assert(sink.n, Equals, 2*writes*len("line\n"))
+}
+
+func (s *PostgresSuite) TestStopWithMode(c *C) {
+	cluster := initdb(c)
+	stopped := false
+	cluster.onStop = func() { stopped = true }
+
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+	// An open connection prevents a smart shutdown from completing.
+	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=postgres", testcheck.Return(cluster.TestConnectString()).(string)))
+	c.Assert(err, IsNil)
+	defer db.Close()
+	c.Assert(db.Ping(), IsNil)
+	used, err := cluster.StopWithMode(Smart, 200*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, Fast)
+	c.Assert(cluster.State(), Equals, Exited)
+	c.Assert(stopped, Equals, true)
+
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+	used, err = cluster.StopWithMode(Immediate, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, Immediate)
+
+	_, err = cluster.StopWithMode(ShutdownMode(10), 0)
+	c.Assert(err, ErrorMatches, ".*invalid shutdown mode 10")
+}
+
+func (s *PostgresSuite) TestContextCancellation(c *C) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cluster := testCluster(c)
+	cluster.DataDir = filepath.Join(cluster.DataDir, "data")
+	c.Assert(cluster.InitContext(cancelled), NotNil)
+	_, err := os.Stat(cluster.DataDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	cluster = initdb(c)
+	dest := filepath.Join(c.MkDir(), "clone")
+	_, err = cluster.CloneContext(cancelled, dest)
+	c.Assert(err, NotNil)
+	_, err = os.Stat(dest)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(cluster.StartContext(ctx), IsNil)
+	c.Assert(cluster.WaitTillServingContext(cancelled), ErrorMatches, "(?s).*context canceled.*")
+	cancel()
+	select {
+	case <-cluster.Done():
+	case <-time.After(10 * time.Second):
+		c.Fatal("server was not stopped on cancellation")
+	}
+	cluster.Wait()
+
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+	c.Assert(cluster.StopContext(cancelled), IsNil)
+	c.Assert(cluster.Running(), Equals, false)
+}
+
+func (s *PostgresSuite) TestApplyConfig(c *C) {
+	cluster := initdb(c)
+	pending, err := cluster.ApplyConfig()
+	c.Assert(err, IsNil)
+	c.Assert(pending, IsNil)
+
+	c.Assert(cluster.Start(), IsNil)
+	defer cluster.Stop()
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+
+	cluster.Config = append(cluster.Config,
+		ConfigOpt{"work_mem", "8MB", "Reloadable"},
+		ConfigOpt{"shared_buffers", "16MB", "Requires a restart"})
+	pending, err = cluster.ApplyConfig()
+	c.Assert(err, IsNil)
+	c.Assert(pending, DeepEquals, []string{"shared_buffers"})
+	cfgData, err := ioutil.ReadFile(filepath.Join(cluster.DataDir, "postgresql.conf"))
+	c.Assert(err, IsNil)
+	c.Assert(string(cfgData), Matches, "(?s).*shared_buffers = 16MB.*")
+
+	c.Assert(cluster.Restart(), IsNil)
+	c.Assert(cluster.WaitTillServing(1*time.Second), IsNil)
+	pending, err = cluster.ApplyConfig()
+	c.Assert(err, IsNil)
+	c.Assert(pending, IsNil)
+
+	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=postgres", testcheck.Return(cluster.TestConnectString()).(string)))
+	c.Assert(err, IsNil)
+	defer db.Close()
+	var value string
+	c.Assert(db.QueryRow("SHOW shared_buffers").Scan(&value), IsNil)
+	c.Assert(value, Equals, "16MB")
+}
+
 func (s *PostgresSuite) TestClone(c *C) {
 	cluster := initdb(c)
 	cloned, err := cluster.Clone(filepath.Join(c.MkDir(), "cloned"))
@@ -132,6 +370,29 @@ func (s *PostgresSuite) TestClone(c *C) {
 	CheckCluster(cloned, c)
 }
 
+func (s *PostgresSuite) TestCloneWithFreePort(c *C) {
+	cluster := initdb(c)
+	cloned, err := cluster.Clone(filepath.Join(c.MkDir(), "cloned"), WithFreePort())
+	c.Assert(err, IsNil)
+	clonedPort := testcheck.Return(cloned.Port()).(int)
+	c.Assert(clonedPort, Not(Equals), testcheck.Return(cluster.Port()).(int))
+	c.Assert(cluster.Config[0].Value, Not(Equals), cloned.Config[0].Value)
+	c.Assert(testcheck.Return(cloned.TestConnectString()).(string), Matches, fmt.Sprintf(".* port=%d .*", clonedPort))
+	CheckCluster(cloned, c)
+}
+
+func (s *PostgresSuite) TestFreePort(c *C) {
+	first, err := freePort(c.MkDir())
+	c.Assert(err, IsNil)
+	second, err := freePort(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Assert(first, Not(Equals), second)
+	c.Assert(portLocked(first, []string{c.MkDir()}), Equals, false)
+	lockDir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(lockDir, fmt.Sprintf(".s.PGSQL.%d.lock", first)), nil, 0600), IsNil)
+	c.Assert(portLocked(first, []string{lockDir}), Equals, true)
+}
+
 func (s *PostgresSuite) TestInitIfNeeded(c *C) {
 	for _, cluster := range []*PostgresCluster{initdb(c), testCluster(c)} {
 		c.Assert(cluster.InitIfNeeded(), IsNil)
@@ -164,12 +425,12 @@ func (s *PostgresSuite) TestFailures(c *C) {
 
 	checkFailure(c, cluster, cloner(c.MkDir()), ".*cannot clone into an existing directory")
 	checkFailure(c, cluster, cluster.Wait, ".*postgres cluster not running")
-	checkFailure(c, cluster, func() error { return cluster.WaitTillServing(10) }, ".*server has not been started")
+	checkFailure(c, cluster, func() error { return cluster.WaitTillServing(10) }, ".*server has not been started.*")
 
 	origOpts := cluster.RunOpts
 	cluster.RunOpts = []ConfigOpt{{Key: "--fake_flag"}}
 	c.Assert(cluster.Start(), IsNil)
-	checkFailure(c, cluster, cluster.Wait, "exit status 1")
+	checkFailure(c, cluster, cluster.Wait, "(?s)exit status 1\nserver output:\n.*")
 	cluster.RunOpts = origOpts
 
 	origBin := cluster.BinDir
@@ -180,15 +441,69 @@ func (s *PostgresSuite) TestFailures(c *C) {
 	c.Assert(cluster.Start(), IsNil)
 
 	checkFailure(c, cluster, cluster.Start, ".*already running.*")
-	checkFailure(c, cluster, cloner(filepath.Join(c.MkDir(), "cloned")), ".*cannot clone a running cluster")
+	checkFailure(c, cluster, cloner(filepath.Join(c.MkDir(), "cloned")), ".*cannot clone a running cluster.*")
 
 	cluster.proc.Process.Signal(syscall.SIGINT)
-	checkFailure(c, cluster, cluster.Stop, ".*signal: interrupt")
+	checkFailure(c, cluster, cluster.Stop, "(?s).*signal: interrupt.*")
 
 	c.Assert(cluster.Start(), IsNil)
 
 	cluster.proc.Process.Signal(syscall.SIGINT)
-	checkFailure(c, cluster, cluster.Wait, ".*signal: interrupt")
+	checkFailure(c, cluster, cluster.Wait, "(?s).*signal: interrupt.*")
+}
+
+func (s *PostgresSuite) TestTypedErrors(c *C) {
+	cluster := testCluster(c)
+	c.Assert(errors.Is(cluster.Start(), ErrNotInitialized), Equals, true)
+	_, err := cluster.Clone(filepath.Join(c.MkDir(), "clone"))
+	c.Assert(errors.Is(err, ErrNotInitialized), Equals, true)
+
+	cluster.InitOpts = []ConfigOpt{{Key: "--fake_flag"}}
+	var initErr *InitdbError
+	c.Assert(errors.As(cluster.Init(), &initErr), Equals, true)
+	c.Assert(initErr.Output, Matches, "(?s).*fake_flag.*")
+
+	cluster = initdb(c)
+	c.Assert(errors.Is(cluster.Init(), ErrAlreadyInitialized), Equals, true)
+	_, err = cluster.Clone(c.MkDir())
+	c.Assert(errors.Is(err, ErrDestExists), Equals, true)
+	c.Assert(errors.Is(cluster.Wait(), ErrNotRunning), Equals, true)
+	c.Assert(errors.Is(cluster.WaitTillServing(10), ErrNotRunning), Equals, true)
+
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(errors.Is(cluster.Start(), ErrAlreadyRunning), Equals, true)
+	_, err = cluster.Clone(filepath.Join(c.MkDir(), "cloned"))
+	c.Assert(errors.Is(err, ErrAlreadyRunning), Equals, true)
+	c.Assert(errors.Is(cluster.Freeze(c.MkDir(), "running"), ErrAlreadyRunning), Equals, true)
+	c.Assert(cluster.Stop(), IsNil)
+
+	cluster.RunOpts = []ConfigOpt{{Key: "--fake_flag"}}
+	c.Assert(cluster.Start(), IsNil)
+	var exitErr *ExitError
+	c.Assert(errors.As(cluster.Wait(), &exitErr), Equals, true)
+	c.Assert(exitErr.Code, Equals, 1)
+	c.Assert(exitErr.Signal, Equals, syscall.Signal(0))
+	c.Assert(len(exitErr.Output) > 0, Equals, true)
+}
+
+func (s *PostgresSuite) TestFailureHandler(c *C) {
+	var failures []interface{}
+	cluster := testCluster(c)
+	cluster.OnFailure = func(args ...interface{}) { failures = append(failures, args...) }
+
+	err := cluster.Start()
+	c.Assert(failures, DeepEquals, []interface{}{err})
+
+	// Errors from nested calls to exported methods are only reported once.
+	cluster.Config = []ConfigOpt{{"port", "this is a bad port", ""}}
+	failures = nil
+	_, err = cluster.SocketFile()
+	c.Assert(err, NotNil)
+	c.Assert(failures, HasLen, 1)
+
+	failures = nil
+	c.Assert(cluster.Stop(), IsNil)
+	c.Assert(failures, IsNil)
 }
 
 func Example() {
@@ -201,15 +516,23 @@ func Example() {
 	}
 	defer func() { os.RemoveAll(tempDir) }()
 
+	// Use the newest postgres installed on this machine.
+	pg, err := FindPostgres("latest")
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	// A postgres cluster which will be created in tempDir and use binaries
-	// from /usr/lib/postgresql/9.3/bin. log.Fatal will be run if any errors
+	// from pg.BinDir. log.Fatal will be run if any errors
 	// occur on any  of the exported methods of ghostgres.
 	// This can also be an instance of testing.T.Fatal to automatically abort
 	// tests on error
 	master := &PostgresCluster{
-		Config:  TestConfig,
-		DataDir: tempDir,
-		BinDir:  "/usr/lib/postgresql/9.3/bin",
+		Config:    TestConfig,
+		DataDir:   tempDir,
+		BinDir:    pg.BinDir,
+		OnFailure: log.Fatal,
 	}
 
 	// Initialize the cluster
@@ -240,15 +563,23 @@ func Example_cloning() {
 	}
 	defer func() { os.RemoveAll(tempDir) }()
 
+	// Use the newest postgres installed on this machine.
+	pg, err := FindPostgres("latest")
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	// A postgres cluster which will be loaded from testdata/templatedb and use binaries
-	// from /usr/lib/postgresql/9.3/bin. log.Fatal will be run if any errors
+	// from pg.BinDir. log.Fatal will be run if any errors
 	// occur on any  of the exported methods of ghostgres.
 	// This can also be an instance of testing.T.Fatal to automatically abort
 	// tests on error
 	master := &PostgresCluster{
-		Config:  TestConfig,
-		DataDir: "testdata/templatedb",
-		BinDir:  "/usr/lib/postgresql/9.3/bin",
+		Config:    TestConfig,
+		DataDir:   "testdata/templatedb",
+		BinDir:    pg.BinDir,
+		OnFailure: log.Fatal,
 	}
 
 	// Initialize the cluster if needed. This allows you to create a template
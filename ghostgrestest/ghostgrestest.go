@@ -0,0 +1,146 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+/*
+Package ghostgrestest provides helpers to use ghostgres clusters in tests with
+no boilerplate. A single call clones a cluster from a template, starts it and
+returns an open connection to it. The cluster is stopped and deleted when the
+test completes.
+
+	func TestQuery(t *testing.T) {
+		db, _ := ghostgrestest.New(t)
+		var count int
+		if err := db.QueryRow("SELECT count(*) FROM pg_database").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+The template must have been created beforehand. See the ghostgres package
+documentation for details.
+
+RunVersions runs a test against every installed major version of postgres,
+creating a template for each version if needed.
+
+	func TestQueryAllVersions(t *testing.T) {
+		ghostgrestest.RunVersions(t, nil, func(t *testing.T, pg *ghostgrestest.Postgres) {
+			db, _ := pg.New(t)
+			// ...
+		})
+	}
+*/
+package ghostgrestest
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/surullabs/ghostgres"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The time allowed for a cluster to stop before it is killed during cleanup.
+const stopTimeout = 10 * time.Second
+
+type options struct {
+	dir, name    string
+	database     string
+	startTimeout time.Duration
+	cloneOpts    []ghostgres.CloneOption
+	template     *ghostgres.Template
+}
+
+// Option configures the cluster created by New.
+type Option func(*options)
+
+// WithTemplate clones the cluster from the template name in dir. dir and name
+// behave as in ghostgres.FromTemplate. The default template is used otherwise.
+func WithTemplate(dir, name string) Option {
+	return func(o *options) { o.dir, o.name = dir, name }
+}
+
+// withTemplate clones the cluster from tpl instead of dir and name.
+func withTemplate(tpl *ghostgres.Template) Option {
+	return func(o *options) { o.template = tpl }
+}
+
+// WithCloneOptions passes opts to ghostgres.FromTemplate, for instance to
+// use ghostgres.WithFreePort in parallel tests.
+func WithCloneOptions(opts ...ghostgres.CloneOption) Option {
+	return func(o *options) { o.cloneOpts = append(o.cloneOpts, opts...) }
+}
+
+// WithDatabase connects to database instead of the postgres database.
+func WithDatabase(database string) Option {
+	return func(o *options) { o.database = database }
+}
+
+// WithStartTimeout sets the time to wait for the cluster to start serving.
+// It defaults to 10 seconds.
+func WithStartTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.startTimeout = timeout }
+}
+
+// New clones a cluster from a template into a temporary directory, starts it
+// and waits for it to serve. It returns an open connection to the cluster and
+// the connection string used to open it. The test is aborted using t.Fatal
+// if any of these steps fail.
+//
+// Once the test and all its subtests complete the connection is closed and
+// the cluster is stopped and deleted. If the test failed, the output of the
+// server and its log file, if logging_collector is enabled, are written to
+// the test log.
+func New(t testing.TB, opts ...Option) (db *sql.DB, dsn string) {
+	t.Helper()
+	o := options{
+		dir:          ghostgres.DefaultTemplateDir,
+		name:         ghostgres.DefaultTemplate,
+		database:     "postgres",
+		startTimeout: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var cluster *ghostgres.PostgresCluster
+	var err error
+	if o.template != nil {
+		cluster, err = o.template.Clone("", o.cloneOpts...)
+	} else {
+		cluster, err = ghostgres.FromTemplate(o.dir, o.name, "", o.cloneOpts...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.OnFailure = t.Fatal
+	t.Cleanup(func() {
+		if t.Failed() {
+			dumpLogs(t, cluster)
+		}
+		cluster.StopWithMode(ghostgres.Fast, stopTimeout)
+	})
+
+	cluster.Start()
+	cluster.WaitTillServing(o.startTimeout)
+	connStr, _ := cluster.TestConnectString()
+	dsn = fmt.Sprintf("%s dbname=%s", connStr, o.database)
+	if db, err = sql.Open("postgres", dsn); err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run in reverse order so the connection is closed before the
+	// cluster is stopped.
+	t.Cleanup(func() { db.Close() })
+	return db, dsn
+}
+
+func dumpLogs(t testing.TB, cluster *ghostgres.PostgresCluster) {
+	for _, line := range cluster.Logs() {
+		t.Log(line)
+	}
+	logFile := filepath.Join(cluster.DataDir, "pg_log", ghostgres.TestLogFileName)
+	if data, err := ioutil.ReadFile(logFile); err == nil {
+		t.Logf("%s:\n%s", logFile, data)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgrestest
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var dataDir string
+	t.Run("cluster", func(t *testing.T) {
+		db, dsn := New(t, WithDatabase("template1"))
+		if dsn == "" {
+			t.Fatal("empty dsn")
+		}
+		var database string
+		if err := db.QueryRow("SELECT current_database()").Scan(&database); err != nil {
+			t.Fatal(err)
+		}
+		if database != "template1" {
+			t.Fatalf("connected to %s instead of template1", database)
+		}
+		if err := db.QueryRow("SHOW data_directory").Scan(&dataDir); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("%s was not removed: %v", dataDir, err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgrestest
+
+import (
+	"database/sql"
+	"github.com/surullabs/ghostgres"
+	"testing"
+)
+
+// Postgres is an installation of postgres passed to the tests run by
+// RunVersions.
+type Postgres struct {
+	ghostgres.Installation
+	// The template created using the installation
+	Template *ghostgres.Template
+}
+
+// New is like the package level New but clones the cluster from p.Template.
+func (p *Postgres) New(t testing.TB, opts ...Option) (db *sql.DB, dsn string) {
+	t.Helper()
+	return New(t, append([]Option{withTemplate(p.Template)}, opts...)...)
+}
+
+// RunVersions runs fn as a subtest for every major version of postgres in
+// versions, such as "9.6" or "16", using the newest installed release of
+// each as found by ghostgres.DiscoverPostgres. If versions is empty fn is
+// run for every installed major version. Subtests are named pg<version>,
+// for example pg16, and are skipped if the version is not installed.
+//
+// Each installation uses the default template for its version which is
+// created using TestConfigWithLogging if it does not exist, as in
+// ghostgres.EnsureTemplate. Use Postgres.New to start a cluster from it.
+//
+//	ghostgrestest.RunVersions(t, []string{"13", "16"}, func(t *testing.T, pg *ghostgrestest.Postgres) {
+//		db, _ := pg.New(t)
+//		// Test against this version
+//	})
+func RunVersions(t *testing.T, versions []string, fn func(t *testing.T, pg *Postgres)) {
+	t.Helper()
+	installations := ghostgres.DiscoverPostgres()
+	if len(versions) == 0 {
+		seen := make(map[string]bool)
+		for _, installation := range installations {
+			if major := installation.Version.MajorVersion(); !seen[major] {
+				seen[major] = true
+				versions = append(versions, major)
+			}
+		}
+	}
+	for _, version := range versions {
+		installation, found, err := newestMatching(installations, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run("pg"+version, func(t *testing.T) {
+			if !found {
+				t.Skipf("postgres %s is not installed", version)
+			}
+			tpl, err := ghostgres.EnsureTemplate(ghostgres.DefaultTemplateDir, ghostgres.DefaultTemplate, ghostgres.PostgresCluster{
+				Config: ghostgres.TestConfigWithLogging,
+				BinDir: installation.BinDir,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn(t, &Postgres{Installation: installation, Template: tpl})
+		})
+	}
+}
+
+// newestMatching returns the first of installations, which are sorted from
+// the newest, that matches version.
+func newestMatching(installations []ghostgres.Installation, version string) (ghostgres.Installation, bool, error) {
+	for _, installation := range installations {
+		matches, err := installation.Matches(version)
+		if err != nil || matches {
+			return installation, matches, err
+		}
+	}
+	return ghostgres.Installation{}, false, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgrestest
+
+import (
+	"github.com/surullabs/ghostgres"
+	"strings"
+	"testing"
+)
+
+func TestNewestMatching(t *testing.T) {
+	installations := []ghostgres.Installation{
+		{BinDir: "/16.2", Version: ghostgres.Version{Major: 16, Minor: 2}},
+		{BinDir: "/16.1", Version: ghostgres.Version{Major: 16, Minor: 1}},
+		{BinDir: "/9.6", Version: ghostgres.Version{Major: 9, Minor: 6, Patch: 24}},
+	}
+	if installation, found, _ := newestMatching(installations, "16"); !found || installation.BinDir != "/16.2" {
+		t.Errorf("found %v for 16", installation)
+	}
+	if installation, found, _ := newestMatching(installations, "9.6"); !found || installation.BinDir != "/9.6" {
+		t.Errorf("found %v for 9.6", installation)
+	}
+	if _, found, _ := newestMatching(installations, "15"); found {
+		t.Error("found an installation of 15")
+	}
+	if _, _, err := newestMatching(installations, "latest!"); err == nil {
+		t.Error("expected an error for an invalid version")
+	}
+}
+
+func TestRunVersions(t *testing.T) {
+	ran := 0
+	RunVersions(t, nil, func(t *testing.T, pg *Postgres) {
+		ran++
+		db, _ := pg.New(t)
+		var version string
+		if err := db.QueryRow("SHOW server_version").Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(version, pg.Version.String()) {
+			t.Fatalf("connected to postgres %s instead of %s", version, pg.Version)
+		}
+	})
+	if ran == 0 {
+		t.Skip("postgres is not installed")
+	}
+	RunVersions(t, []string{"1"}, func(t *testing.T, pg *Postgres) {
+		t.Fatal("ran a test for postgres 1")
+	})
+}
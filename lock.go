@@ -0,0 +1,33 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How often a contended lock is retried.
+const lockPollInterval = 10 * time.Millisecond
+
+// errLockBusy is returned by tryLock if the lock is held elsewhere.
+var errLockBusy = errors.New("lock is held")
+
+// lockFile acquires a shared or exclusive lock on path, creating the file if
+// needed, and waits until the lock is acquired or ctx is done. Locks
+// coordinate processes as well as goroutines.
+func lockFile(ctx context.Context, path string, exclusive bool) (*fileLock, error) {
+	for {
+		l, err := tryLock(path, exclusive)
+		if err != errLockBusy {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+//go:build !unix && !windows
+
+package ghostgres
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// The holder of a lock touches its directory every lockRefreshInterval. A
+// lock which has not been touched for lockStaleAge was left behind by a
+// process which exited without releasing it and is taken over.
+const (
+	lockRefreshInterval = 10 * time.Second
+	lockStaleAge        = time.Minute
+)
+
+// fileLock is a lock held by creating the directory path.d. Creating a
+// directory is atomic on every platform but, unlike flock, the lock is not
+// released if the process exits, which is why stale locks are taken over.
+// Shared locks are exclusive so concurrent clones of a template are
+// serialized on these platforms.
+type fileLock struct {
+	dir  string
+	stop chan struct{}
+}
+
+// tryLock acquires the lock on path without waiting.
+func tryLock(path string, exclusive bool) (*fileLock, error) {
+	dir := path + ".d"
+	err := os.Mkdir(dir, 0700)
+	if os.IsExist(err) && removeStaleLock(dir) {
+		err = os.Mkdir(dir, 0700)
+	}
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errLockBusy
+		}
+		return nil, err
+	}
+	l := &fileLock{dir, make(chan struct{})}
+	go l.refresh()
+	return l, nil
+}
+
+// removeStaleLock removes the lock directory dir if it is stale and reports
+// whether it did.
+func removeStaleLock(dir string) bool {
+	if info, err := os.Stat(dir); err != nil || time.Since(info.ModTime()) < lockStaleAge {
+		return false
+	}
+	// Renaming the directory away means only one waiter takes it over.
+	stale := fmt.Sprintf("%s.stale%d", dir, time.Now().UnixNano())
+	if os.Rename(dir, stale) != nil {
+		return false
+	}
+	if info, err := os.Stat(stale); err == nil && time.Since(info.ModTime()) < lockStaleAge {
+		// Another waiter took over the lock before it was renamed.
+		os.Rename(stale, dir)
+		return false
+	}
+	os.Remove(stale)
+	return true
+}
+
+// refresh touches the lock directory until the lock is released.
+func (l *fileLock) refresh() {
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(l.dir, now, now)
+		}
+	}
+}
+
+// unlock releases the lock by removing its directory.
+func (l *fileLock) unlock() {
+	close(l.stop)
+	os.Remove(l.dir)
+}
@@ -0,0 +1,69 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"errors"
+	. "launchpad.net/gocheck"
+	"path/filepath"
+	"time"
+)
+
+func (s *PostgresSuite) TestLockFile(c *C) {
+	path := filepath.Join(c.MkDir(), "lock")
+	ctx := context.Background()
+	first, err := lockFile(ctx, path, false)
+	c.Assert(err, IsNil)
+	second, err := lockFile(ctx, path, false)
+	c.Assert(err, IsNil)
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = lockFile(short, path, true)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	acquired := make(chan *fileLock)
+	go func() {
+		l, err := lockFile(ctx, path, true)
+		c.Check(err, IsNil)
+		acquired <- l
+	}()
+	first.unlock()
+	select {
+	case <-acquired:
+		c.Fatal("exclusive lock acquired while a shared lock is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	second.unlock()
+	(<-acquired).unlock()
+}
+
+func (s *PostgresSuite) TestConcurrentFreeze(c *C) {
+	cluster := initdb(c)
+	freezeDir := c.MkDir()
+	const freezers = 4
+	errs := make(chan error, freezers)
+	for i := 0; i < freezers; i++ {
+		go func() { errs <- cluster.Freeze(freezeDir, "concurrent") }()
+	}
+	created := 0
+	for i := 0; i < freezers; i++ {
+		if err := <-errs; err == nil {
+			created++
+		} else {
+			c.Assert(errors.Is(err, ErrTemplateExists), Equals, true, Commentf("%v", err))
+		}
+	}
+	c.Assert(created, Equals, 1)
+	staging, err := filepath.Glob(filepath.Join(freezeDir, "concurrent", "*.tmp*"))
+	c.Assert(err, IsNil)
+	c.Assert(staging, HasLen, 0)
+
+	cloned, err := FromTemplate(freezeDir, "concurrent", filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, IsNil)
+	CheckCluster(cloned, c)
+	c.Assert(Delete(freezeDir, "concurrent"), IsNil)
+	c.Assert(cluster.Freeze(freezeDir, "concurrent"), IsNil)
+}
@@ -0,0 +1,38 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+//go:build unix
+
+package ghostgres
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory lock held on a file using flock. Every lock uses
+// its own file descriptor and is released if the process exits.
+type fileLock struct{ f *os.File }
+
+// tryLock acquires a shared or exclusive lock on path without waiting.
+func tryLock(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+			return nil, errLockBusy
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return &fileLock{f}, nil
+}
+
+// unlock releases the lock by closing the file.
+func (l *fileLock) unlock() { l.f.Close() }
@@ -0,0 +1,51 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+//go:build windows
+
+package ghostgres
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Flags and errors of LockFileEx.
+const (
+	lockfileFailImmediately               = 0x1
+	lockfileExclusiveLock                 = 0x2
+	errLockViolation        syscall.Errno = 33
+)
+
+// fileLock is a lock held on a file using LockFileEx. Every lock uses its
+// own handle and is released if the process exits.
+type fileLock struct{ f *os.File }
+
+// tryLock acquires a shared or exclusive lock on path without waiting.
+func tryLock(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	// Lock the first byte, which is enough since every lock covers the
+	// same range.
+	overlapped := new(syscall.Overlapped)
+	if ok, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(overlapped))); ok == 0 {
+		f.Close()
+		if err == errLockViolation {
+			return nil, errLockBusy
+		}
+		return nil, &os.PathError{Op: "LockFileEx", Path: path, Err: err}
+	}
+	return &fileLock{f}, nil
+}
+
+// unlock releases the lock by closing the file.
+func (l *fileLock) unlock() { l.f.Close() }
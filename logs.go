@@ -0,0 +1,160 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The number of lines of server output retained by a PostgresCluster.
+const maxLogLines = 1000
+
+// The number of lines of server output attached to errors.
+const errorLogLines = 20
+
+// LogLine is a single line written by the postgres server to stdout or stderr.
+type LogLine struct {
+	Time time.Time
+	// Either "stdout" or "stderr"
+	Stream string
+	Text   string
+}
+
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s [%s] %s", l.Time.Format("15:04:05.000"), l.Stream, l.Text)
+}
+
+// logBuffer is a ring buffer holding the most recent lines of server output.
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []LogLine
+	// The total number of lines ever written. The ring holds lines
+	// [total-len(lines), total).
+	total   int
+	partial map[string][]byte
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{lines: make([]LogLine, 0, maxLogLines), partial: make(map[string][]byte)}
+}
+
+// writer returns an io.Writer for stream which records complete lines in the
+// buffer and copies all output to sink if it is not nil.
+func (b *logBuffer) writer(stream string, sink io.Writer) io.Writer {
+	return &streamWriter{buf: b, stream: stream, sink: sink}
+}
+
+func (b *logBuffer) add(stream string, text string) {
+	line := LogLine{Time: time.Now(), Stream: stream, Text: text}
+	if len(b.lines) < maxLogLines {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.total%maxLogLines] = line
+	}
+	b.total++
+}
+
+// write records the complete lines in data and copies data to sink if it is
+// not nil. The sink is written while holding the lock since the stdout and
+// stderr writers share it.
+func (b *logBuffer) write(stream string, data []byte, sink io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sink != nil {
+		// The server must never block or fail because of a broken sink.
+		sink.Write(data)
+	}
+	data = append(b.partial[stream], data...)
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		b.add(stream, string(data[:end]))
+		data = data[end+1:]
+	}
+	b.partial[stream] = append([]byte(nil), data...)
+}
+
+// flush records any incomplete lines. It is called once the server has exited.
+func (b *logBuffer) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for stream, data := range b.partial {
+		if len(data) > 0 {
+			b.add(stream, string(data))
+		}
+		delete(b.partial, stream)
+	}
+}
+
+// mark returns a position which can be passed to since.
+func (b *logBuffer) mark() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// since returns at most n of the most recent lines written after mark. A
+// negative n returns all retained lines.
+func (b *logBuffer) since(mark, n int) []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	first := b.total - len(b.lines)
+	if mark > first {
+		first = mark
+	}
+	if n >= 0 && b.total-n > first {
+		first = b.total - n
+	}
+	lines := make([]LogLine, 0, b.total-first)
+	for i := first; i < b.total; i++ {
+		lines = append(lines, b.lines[i%maxLogLines])
+	}
+	return lines
+}
+
+type streamWriter struct {
+	buf    *logBuffer
+	stream string
+	sink   io.Writer
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	w.buf.write(w.stream, data, w.sink)
+	return len(data), nil
+}
+
+// outputError attaches the most recent server output to an error.
+type outputError struct {
+	err    error
+	output []LogLine
+}
+
+func (e *outputError) Error() string { return withOutputText(e.err, e.output) }
+
+func (e *outputError) Unwrap() error { return e.err }
+
+// withOutput attaches server output written since the process started to err.
+func (p *process) withOutput(err error) error {
+	if err == nil || p.logs == nil {
+		return err
+	}
+	return &outputError{err: err, output: p.logs.since(p.logStart, errorLogLines)}
+}
+
+// Logs returns the most recent lines written by the postgres server to stdout
+// and stderr, across restarts, oldest first. At most 1000 lines are retained.
+// Please note that once logging_collector is enabled, as in LoggingConfig, the
+// server writes its logs to DataDir/pg_log instead.
+func (p *PostgresCluster) Logs() []LogLine {
+	if p.logs == nil {
+		return nil
+	}
+	return p.logs.since(0, -1)
+}
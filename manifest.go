@@ -0,0 +1,251 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The version of the manifest format written by Freeze. Templates with a
+// different manifest version are rejected. Version 2 records the locale of
+// the template and no longer stores it in the data directory.
+const manifestVersion = 2
+
+// Manifest describes how a template was built. Freeze stores it next to the
+// template data and FromTemplate verifies it before cloning.
+type Manifest struct {
+	// The version of the manifest format
+	Version int
+	// The output of postgres --version for the binary that built the template
+	PostgresVersion string
+	// The options passed to initdb
+	InitOpts []ConfigOpt
+	// The encoding and locale of the cluster as reported by initdb when it
+	// was initialized. They are empty if the cluster was not initialized or
+	// cloned from a template by ghostgres.
+	Encoding string
+	Collate  string
+	CType    string
+	// When the template was created
+	Created time.Time
+	// A SHA-256 checksum of the paths, permissions and contents of every
+	// file in the template data directory
+	Checksum string
+	// A hash of the inputs the template was built from, such as the scripts
+	// applied by SeedTemplate or MigrateTemplate
+	Inputs string `json:",omitempty"`
+}
+
+// postgresVersions caches the output of postgres --version by binary and
+// modification time so that it is not run every time a template is cloned.
+var postgresVersions sync.Map
+
+// fullPostgresVersion returns the output of postgres --version for the
+// binaries in binDir.
+func fullPostgresVersion(binDir string) string {
+	binary := filepath.Join(binDir, "postgres")
+	key := ""
+	if info, err := os.Stat(binary); err == nil {
+		key = fmt.Sprintf("%s\x00%d\x00%d", binary, info.ModTime().UnixNano(), info.Size())
+		if version, cached := postgresVersions.Load(key); cached {
+			return version.(string)
+		}
+	}
+	out := check.Return(exec.Command(binary, "--version").Output()).([]byte)
+	version := strings.TrimSpace(string(out))
+	if key != "" {
+		postgresVersions.Store(key, version)
+	}
+	return version
+}
+
+// initOptValue returns the value of the first initdb option in opts named
+// one of names, supporting both {"--encoding", "UTF8"} and
+// {"--encoding=UTF8", ""}.
+func initOptValue(opts []ConfigOpt, names ...string) string {
+	for _, opt := range opts {
+		key, value := opt.Key, opt.Value
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value = key[:i], key[i+1:]
+		}
+		for _, name := range names {
+			if key == name {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// requestedLocale returns the locale category used by initdb, following
+// the precedence of setlocale. It must be called from the process running
+// initdb since it inspects the environment.
+func requestedLocale(opts []ConfigOpt, flag, category string) string {
+	if value := initOptValue(opts, flag, "--locale"); value != "" {
+		return value
+	}
+	for _, env := range []string{"LC_ALL", category, "LANG"} {
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+	}
+	return "C"
+}
+
+// initLocale is the encoding and locale of a cluster.
+type initLocale struct {
+	Encoding, Collate, CType string
+}
+
+var (
+	initdbLocale   = regexp.MustCompile(`initialized with locale "([^"]*)"`)
+	initdbCollate  = regexp.MustCompile(`(?m)^\s*(?:LC_)?COLLATE:\s*(\S+)`)
+	initdbCType    = regexp.MustCompile(`(?m)^\s*(?:LC_)?CTYPE:\s*(\S+)`)
+	initdbEncoding = regexp.MustCompile(`encoding has (?:accordingly )?been set to "([^"]*)"`)
+)
+
+// parseInitLocale returns the encoding and locale reported in the output of
+// initdb. Values initdb did not report are taken from the options and
+// environment it was run with.
+func parseInitLocale(output string, opts []ConfigOpt) initLocale {
+	find := func(re *regexp.Regexp) string {
+		if match := re.FindStringSubmatch(output); match != nil {
+			return match[1]
+		}
+		return ""
+	}
+	l := initLocale{Encoding: find(initdbEncoding), Collate: find(initdbLocale)}
+	l.CType = l.Collate
+	if l.Encoding == "" {
+		l.Encoding = initOptValue(opts, "--encoding", "-E")
+	}
+	if collate := find(initdbCollate); collate != "" {
+		l.Collate = collate
+	} else if l.Collate == "" {
+		l.Collate = requestedLocale(opts, "--lc-collate", "LC_COLLATE")
+	}
+	if ctype := find(initdbCType); ctype != "" {
+		l.CType = ctype
+	} else if l.CType == "" {
+		l.CType = requestedLocale(opts, "--lc-ctype", "LC_CTYPE")
+	}
+	return l
+}
+
+// locale returns the encoding and locale recorded in the manifest.
+func (m *Manifest) locale() initLocale {
+	return initLocale{Encoding: m.Encoding, Collate: m.Collate, CType: m.CType}
+}
+
+func newManifest(c *PostgresCluster, dataDir, inputs string) *Manifest {
+	return &Manifest{
+		Version:         manifestVersion,
+		PostgresVersion: fullPostgresVersion(c.BinDir),
+		InitOpts:        c.InitOpts,
+		Encoding:        c.locale.Encoding,
+		Collate:         c.locale.Collate,
+		CType:           c.locale.CType,
+		Created:         time.Now().UTC(),
+		Checksum:        check.Return(dataChecksum(dataDir)).(string),
+		Inputs:          inputs,
+	}
+}
+
+// dataChecksum hashes the relative path, permissions and contents of every
+// file and symbolic link under dir.
+func dataChecksum(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(relPath), mode)
+		switch {
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, link)
+		case mode.IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = io.Copy(hash, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (t ghostgresTemplate) manifestPath() string { return filepath.Join(t.path(), "manifest.json") }
+
+func (t ghostgresTemplate) readManifest() (*Manifest, error) {
+	data, err := ioutil.ReadFile(t.manifestPath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w: no manifest", t.path(), ErrTemplateInvalid)
+	} else if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", t.path(), ErrTemplateInvalid, err)
+	}
+	return m, nil
+}
+
+// Checksums are verified once per process for every template and manifest.
+var verifiedTemplates sync.Map
+
+// verify checks that the template was built by the postgres binaries in
+// binDir and that its data has not been modified since it was frozen.
+func (t ghostgresTemplate) verify(binDir string) error {
+	m, err := t.readManifest()
+	if err != nil {
+		return err
+	}
+	if m.Version != manifestVersion {
+		return fmt.Errorf("%s: %w: unsupported manifest version %d", t.path(), ErrTemplateInvalid, m.Version)
+	}
+	if current := fullPostgresVersion(binDir); m.PostgresVersion != current {
+		return fmt.Errorf("%s: %w: built by %q but using %q", t.path(), ErrTemplateInvalid, m.PostgresVersion, current)
+	}
+	key := t.path() + "\x00" + m.Checksum
+	if _, verified := verifiedTemplates.Load(key); verified {
+		return nil
+	}
+	checksum, err := dataChecksum(t.data())
+	if err != nil {
+		return err
+	}
+	if checksum != m.Checksum {
+		return fmt.Errorf("%s: %w: checksum mismatch", t.path(), ErrTemplateInvalid)
+	}
+	verifiedTemplates.Store(key, true)
+	return nil
+}
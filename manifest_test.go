@@ -0,0 +1,148 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (s *PostgresSuite) TestInitOptValue(c *C) {
+	opts := []ConfigOpt{{"--auth", "trust", ""}, {"-E", "UTF8", ""}, {"--lc-collate=de_DE.UTF-8", "", ""}}
+	c.Assert(initOptValue(opts, "--encoding", "-E"), Equals, "UTF8")
+	c.Assert(initOptValue(opts, "--lc-collate"), Equals, "de_DE.UTF-8")
+	c.Assert(initOptValue(opts, "--locale"), Equals, "")
+	c.Assert(requestedLocale(opts, "--lc-collate", "LC_COLLATE"), Equals, "de_DE.UTF-8")
+}
+
+func (s *PostgresSuite) TestParseInitLocale(c *C) {
+	same := `The files belonging to this database system will be owned by user "pg".
+The database cluster will be initialized with locale "en_US.UTF-8".
+The default database encoding has accordingly been set to "UTF8".
+`
+	c.Assert(parseInitLocale(same, nil), Equals, initLocale{"UTF8", "en_US.UTF-8", "en_US.UTF-8"})
+	mixed := `The database cluster will be initialized with locales
+  COLLATE:  C
+  CTYPE:    de_DE.UTF-8
+  MESSAGES: C
+The default database encoding has accordingly been set to "UTF8".
+`
+	c.Assert(parseInitLocale(mixed, nil), Equals, initLocale{"UTF8", "C", "de_DE.UTF-8"})
+	modern := `The database cluster will be initialized with this locale configuration:
+  locale provider:   libc
+  LC_COLLATE:  C
+  LC_CTYPE:    C.UTF-8
+  LC_MESSAGES: C
+The default database encoding has accordingly been set to "UTF8".
+`
+	c.Assert(parseInitLocale(modern, nil), Equals, initLocale{"UTF8", "C", "C.UTF-8"})
+	// Values missing from the output are taken from the initdb options.
+	opts := []ConfigOpt{{"-E", "LATIN1", ""}, {"--locale", "de_DE", ""}}
+	c.Assert(parseInitLocale("", opts), Equals, initLocale{"LATIN1", "de_DE", "de_DE"})
+}
+
+func (s *PostgresSuite) TestFullPostgresVersionCached(c *C) {
+	binDir := c.MkDir()
+	count := filepath.Join(binDir, "count")
+	write := func(version string) {
+		script := fmt.Sprintf("#!/bin/sh\necho run >> %s\necho 'postgres (PostgreSQL) %s'\n", count, version)
+		c.Assert(ioutil.WriteFile(filepath.Join(binDir, "postgres"), []byte(script), 0700), IsNil)
+	}
+	runs := func() int {
+		data, _ := ioutil.ReadFile(count)
+		return strings.Count(string(data), "run")
+	}
+	write("16.2")
+	c.Assert(fullPostgresVersion(binDir), Equals, "postgres (PostgreSQL) 16.2")
+	c.Assert(fullPostgresVersion(binDir), Equals, "postgres (PostgreSQL) 16.2")
+	c.Assert(runs(), Equals, 1)
+	// Replacing the binary invalidates the cache.
+	write("16.10")
+	c.Assert(fullPostgresVersion(binDir), Equals, "postgres (PostgreSQL) 16.10")
+	c.Assert(runs(), Equals, 2)
+}
+
+func (s *PostgresSuite) TestDataChecksum(c *C) {
+	dir := strategyTree(c)
+	sum, err := dataChecksum(dir)
+	c.Assert(err, IsNil)
+	c.Assert(sum, HasLen, 64)
+	copied := filepath.Join(c.MkDir(), "copy")
+	c.Assert(CopyStrategy.Copy(context.Background(), dir, copied), IsNil)
+	c.Assert(testcheck.Return(dataChecksum(copied)).(string), Equals, sum)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(copied, "PG_VERSION"), []byte("9.4\n"), 0600), IsNil)
+	c.Assert(testcheck.Return(dataChecksum(copied)).(string), Not(Equals), sum)
+	c.Assert(os.Chmod(filepath.Join(copied, "PG_VERSION"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(copied, "PG_VERSION"), []byte("9.3\n"), 0644), IsNil)
+	c.Assert(testcheck.Return(dataChecksum(copied)).(string), Not(Equals), sum)
+}
+
+func (s *PostgresSuite) TestTemplateManifest(c *C) {
+	cluster := testCluster(c)
+	cluster.InitOpts = []ConfigOpt{{"--encoding", "UTF8", ""}, {"--locale", "C", ""}}
+	c.Assert(cluster.Init(), IsNil)
+	freezeDir := c.MkDir()
+	c.Assert(cluster.Freeze(freezeDir, "manifest"), IsNil)
+	tpl := newTemplate(freezeDir, "manifest")
+	m, err := tpl.readManifest()
+	c.Assert(err, IsNil)
+	c.Assert(m.Version, Equals, manifestVersion)
+	c.Assert(m.PostgresVersion, Matches, ".*"+postgresVersion()+".*")
+	c.Assert(m.Encoding, Equals, "UTF8")
+	c.Assert(m.Collate, Equals, "C")
+	c.Assert(m.CType, Equals, "C")
+	c.Assert(m.Checksum, Equals, testcheck.Return(dataChecksum(tpl.data())).(string))
+
+	// The locale is kept when a clone is frozen in turn.
+	cloned, err := FromTemplate(freezeDir, "manifest", filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, IsNil)
+	c.Assert(cloned.Freeze(freezeDir, "refrozen"), IsNil)
+	refrozen, err := newTemplate(freezeDir, "refrozen").readManifest()
+	c.Assert(err, IsNil)
+	c.Assert(refrozen.Encoding, Equals, "UTF8")
+	c.Assert(refrozen.Collate, Equals, "C")
+	c.Assert(refrozen.CType, Equals, "C")
+
+	// A template that was modified is refused.
+	c.Assert(ioutil.WriteFile(filepath.Join(tpl.data(), "PG_VERSION"), []byte("tampered"), 0600), IsNil)
+	_, err = FromTemplate(freezeDir, "manifest", filepath.Join(c.MkDir(), "clone"))
+	c.Assert(errors.Is(err, ErrTemplateInvalid), Equals, true)
+	c.Assert(err, ErrorMatches, "(?s).*checksum mismatch.*")
+
+	// As is one without a manifest.
+	c.Assert(os.Remove(tpl.manifestPath()), IsNil)
+	_, err = FromTemplate(freezeDir, "manifest", filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, ErrorMatches, "(?s).*no manifest.*")
+}
+
+func (s *PostgresSuite) TestManifestVersion(c *C) {
+	dir := c.MkDir()
+	fakeTemplate(c, dir, "old", "9.3.5", time.Now())
+	t := ghostgresTemplate(filepath.Join(dir, "old", "9.3.5"))
+	c.Assert(ioutil.WriteFile(t.manifestPath(), []byte(`{"Version": 1}`), 0600), IsNil)
+	err := t.verify(fakeBinDir(c, "9.3.5"))
+	c.Assert(errors.Is(err, ErrTemplateInvalid), Equals, true)
+	c.Assert(err, ErrorMatches, ".*unsupported manifest version 1")
+}
+
+func (s *PostgresSuite) TestEnsureTemplateRebuilds(c *C) {
+	dir := c.MkDir()
+	spec := *testCluster(c)
+	tpl, err := EnsureTemplate(dir, "rebuilt", spec)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(newTemplate(dir, "rebuilt").manifestPath()), IsNil)
+	tpl, err = EnsureTemplate(dir, "rebuilt", spec)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, true)
+	_, err = tpl.Clone(filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, IsNil)
+}
@@ -4,6 +4,7 @@
 package ghostgres
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,77 +13,260 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
-	"regexp"
+	"testing"
+	"time"
 )
 
 const templateDir = "testdata/template"
 
 var pgBinDir = flag.String("ghostgres_pg_bin_dir", "", "Directory containing PostgreSQL binaries")
 var defaultName = flag.String("ghostgres_template", "default", "The value for the default template database")
+var templateStoreDir = flag.String("ghostgres_template_dir", "", "Directory in which DefaultTemplateDir templates are stored")
+
+// TemplateStoreEnv names the environment variable which overrides the
+// directory used for DefaultTemplateDir.
+const TemplateStoreEnv = "GHOSTGRES_TEMPLATE_DIR"
 
 func postgresBinary() string { return filepath.Join(*pgBinDir, "postgres") }
 
-func parseVersion(output string) (version string) {
-	version = regexp.MustCompile("[0-9]+\\.[0-9]+\\.[0-9]+").FindString(output)
-	check.True(version != "", fmt.Sprintf("failed to parse postgres version from %s", output))
-	return
+func parseVersion(output string) Version {
+	version, err := ParseVersion(output)
+	check.Error(err)
+	return version
 }
 
 func postgresVersion() (version string) {
-	return parseVersion(string(check.Return(exec.Command(postgresBinary(), "--version").Output()).([]byte)))
+	return postgresVersionIn(*pgBinDir)
+}
+
+// postgresVersionIn returns the version of the postgres binaries in binDir
+// formatted as used in template directory names.
+func postgresVersionIn(binDir string) (version string) {
+	return postgresVersionOf(binDir).String()
+}
+
+func postgresVersionOf(binDir string) Version {
+	return parseVersion(fullPostgresVersion(binDir))
+}
+
+// postgresBinDir returns binDir or, if it is empty, the directory of the
+// postgres found in PATH, which is the one used for an empty binDir.
+func postgresBinDir(binDir string) string {
+	if binDir != "" {
+		return binDir
+	}
+	if postgres, err := exec.LookPath("postgres"); err == nil {
+		return filepath.Dir(postgres)
+	}
+	return ""
 }
 
 type ghostgresTemplate string
 
 var gopathFn = func() string { return os.Getenv("GOPATH") }
+var userCacheDirFn = os.UserCacheDir
+
+// TemplateStore returns the directory used when DefaultTemplateDir is passed
+// to Freeze or FromTemplate. It is, in order of preference,
+//
+//	the value of the ghostgres_template_dir flag
+//	the value of the GHOSTGRES_TEMPLATE_DIR environment variable
+//	<path_to_ghostgres>/testdata/template if ghostgres is in GOPATH
+//	<user_cache_dir>/ghostgres/template
+//
+// where user_cache_dir is the result of os.UserCacheDir. The last is used in
+// module mode since the module cache is read only.
+func TemplateStore() (dir string, err error) {
+	defer recoverFault(&err)
+	return templateStore(), nil
+}
+
+func templateStore() string {
+	if *templateStoreDir != "" {
+		return *templateStoreDir
+	}
+	if dir := os.Getenv(TemplateStoreEnv); dir != "" {
+		return dir
+	}
+	// Use reflection to determine the package path so we're safe from package
+	// relocations.
+	pkg := reflect.TypeOf(PostgresCluster{}).PkgPath()
+	if gopath := gopathFn(); gopath != "" {
+		pkgPath := filepath.Join(gopath, filepath.Join("src", pkg))
+		if info, err := os.Stat(pkgPath); err == nil && info.IsDir() {
+			return filepath.Join(pkgPath, templateDir)
+		}
+	}
+	cacheDir, err := userCacheDirFn()
+	check.True(err == nil, fmt.Sprintf("GOPATH is not set and there is no user cache directory (%v). Unable to locate templates", err))
+	return filepath.Join(cacheDir, filepath.Base(pkg), "template")
+}
 
 func newTemplate(root, name string) ghostgresTemplate {
+	return newTemplateFor(root, name, *pgBinDir)
+}
+
+// newTemplateFor locates a template for the version of postgres in binDir.
+func newTemplateFor(root, name, binDir string) ghostgresTemplate {
 	if root == DefaultTemplateDir {
-		gopath := gopathFn()
-		check.True(gopath != "", "GOPATH is not set. Unable to locate templates")
-		// Use reflection to determine the package path so we're safe from package
-		// relocations.
-		pkgPath := filepath.Join(gopath, filepath.Join("src", reflect.TypeOf(PostgresCluster{}).PkgPath()))
-		root = filepath.Join(pkgPath, templateDir)
+		root = templateStore()
 	}
 	if name == DefaultTemplate {
 		name = *defaultName
 	}
-	return ghostgresTemplate(filepath.Join(root, filepath.Join(name, filepath.Join(postgresVersion()))))
+	return ghostgresTemplate(filepath.Join(root, filepath.Join(name, filepath.Join(postgresVersionIn(binDir)))))
 }
 
 func (t ghostgresTemplate) path() string   { return string(t) }
 func (t ghostgresTemplate) data() string   { return filepath.Join(t.path(), "data") }
 func (t ghostgresTemplate) config() string { return filepath.Join(t.path(), "ghostgres.json") }
+
+// The lock file is kept next to the template so that it survives the
+// template being replaced or deleted.
+func (t ghostgresTemplate) lockPath() string { return t.path() + ".lock" }
+
+// Templates are built in a staging directory next to the template which is
+// renamed into place once complete.
+func (t ghostgresTemplate) stagingPrefix() string { return filepath.Base(t.path()) + ".tmp" }
 func (t ghostgresTemplate) exists() bool {
 	_, err := os.Stat(t.config())
 	return err == nil
 }
-func (t ghostgresTemplate) clone(cloneDir string) *PostgresCluster {
+
+// lock acquires a lock on the template which is shared by readers and held
+// exclusively while the template is created or deleted.
+func (t ghostgresTemplate) lock(ctx context.Context, exclusive bool) *fileLock {
+	check.Error(os.MkdirAll(filepath.Dir(t.path()), 0700))
+	return check.Return(lockFile(ctx, t.lockPath(), exclusive)).(*fileLock)
+}
+
+// The longest a clone waits for a template which is being created or deleted.
+const cloneLockTimeout = 5 * time.Minute
+
+func (t ghostgresTemplate) clone(binDir, cloneDir string, opts []CloneOption) *PostgresCluster {
+	ctx, cancel := context.WithTimeout(context.Background(), cloneLockTimeout)
+	defer cancel()
+	l, err := lockFile(ctx, t.lockPath(), false)
+	if err == context.DeadlineExceeded {
+		check.Error(fmt.Errorf("%s: timed out waiting for the template lock", t.path()))
+	}
+	// Templates in read only directories are cloned without a lock.
+	if err == nil {
+		defer l.unlock()
+	}
 	cluster := PostgresCluster{}
 	check.Error(json.Unmarshal(check.Return(ioutil.ReadFile(t.config())).([]byte), &cluster))
+	// The clone must run the binaries the template was verified against.
+	binDir = postgresBinDir(binDir)
+	check.Error(t.verify(binDir))
+	// ghostgres.json does not record the locale. Take it from the manifest so
+	// that it is known if the clone is frozen in turn.
+	cluster.locale = check.Return(t.readManifest()).(*Manifest).locale()
+	// The template may have been built elsewhere, possibly on a machine with
+	// a different postgres layout, before being moved here.
+	cluster.DataDir = t.data()
+	cluster.BinDir = binDir
 	var onStop func()
+	tmpfs := ""
 	if cloneDir == "" {
-		tempDir := check.Return(ioutil.TempDir("", "ghostgres_clone")).(string)
+		if newCloneOptions(opts).ephemeral {
+			tmpfs = ephemeralTempDir(t.data())
+		}
+		tempDir := check.Return(ioutil.TempDir(tmpfs, "ghostgres_clone")).(string)
 		cloneDir = filepath.Join(tempDir, "clone")
 		onStop = func() { os.RemoveAll(tempDir) }
 	}
-	cloned := check.Return(cluster.Clone(cloneDir)).(*PostgresCluster)
+	cloned, err := cluster.Clone(cloneDir, opts...)
+	if err != nil && onStop != nil {
+		onStop()
+	}
+	check.Error(err)
 	cloned.onStop = onStop
+	cloned.cloneStats.Tmpfs = tmpfs != ""
 	return cloned
 }
-func (t ghostgresTemplate) createFrom(c *PostgresCluster) (err error) {
-	check.True(!c.Running(), "cannot create a template from a running cluster")
-	check.Error(os.MkdirAll(t.path(), 0700))
-	clone := check.Return(c.Clone(t.data())).(*PostgresCluster)
+func (t ghostgresTemplate) createFrom(ctx context.Context, c *PostgresCluster) (err error) {
+	requireTrue(!c.Running(), fmt.Errorf("cannot create a template from a running cluster: %w", ErrAlreadyRunning))
+	defer t.lock(ctx, true).unlock()
+	requireTrue(!t.exists(), fmt.Errorf("%s: %w", t.path(), ErrTemplateExists))
+	t.publish(ctx, c, "")
+	return nil
+}
+
+// publish copies c, built from inputs, into the template. It must be called
+// with an exclusive lock held on the template.
+func (t ghostgresTemplate) publish(ctx context.Context, c *PostgresCluster, inputs string) {
+	// Holding the lock means that anything left behind was abandoned by a
+	// process which exited before it could publish a template.
+	stale := check.Return(filepath.Glob(filepath.Join(filepath.Dir(t.path()), t.stagingPrefix()+"*"))).([]string)
+	for _, dir := range append(stale, t.path()) {
+		check.Error(os.RemoveAll(dir))
+	}
+
+	staging := check.Return(ioutil.TempDir(filepath.Dir(t.path()), t.stagingPrefix())).(string)
+	published := false
+	defer func() {
+		if !published {
+			os.RemoveAll(staging)
+		}
+	}()
+	clone := check.Return(c.CloneContext(ctx, filepath.Join(staging, "data"))).(*PostgresCluster)
+	clone.DataDir = t.data()
 	marshalled := check.Return(json.MarshalIndent(clone, "", "  ")).([]byte)
-	return ioutil.WriteFile(t.config(), marshalled, 0600)
+	check.Error(ioutil.WriteFile(filepath.Join(staging, "ghostgres.json"), marshalled, 0600))
+	manifest := check.Return(json.MarshalIndent(newManifest(c, filepath.Join(staging, "data"), inputs), "", "  ")).([]byte)
+	check.Error(ioutil.WriteFile(filepath.Join(staging, "manifest.json"), manifest, 0600))
+	check.Error(os.Rename(staging, t.path()))
+	published = true
+}
+
+// current reports whether the template exists, is valid and was built from
+// inputs.
+func (t ghostgresTemplate) current(binDir, inputs string) bool {
+	if !t.exists() || t.verify(binDir) != nil {
+		return false
+	}
+	m, err := t.readManifest()
+	return err == nil && m.Inputs == inputs
+}
+
+// ensure creates the template from a cluster initialized using spec unless
+// a valid template built from inputs exists and reports whether it was
+// created. If prepare is not nil it is called with the stopped cluster
+// before it is frozen.
+func (t ghostgresTemplate) ensure(ctx context.Context, spec PostgresCluster, inputs string, prepare func(context.Context, *PostgresCluster)) (created bool) {
+	if t.current(spec.BinDir, inputs) {
+		return false
+	}
+	defer t.lock(ctx, true).unlock()
+	// Another process may have created the template while we waited.
+	if t.current(spec.BinDir, inputs) {
+		return false
+	}
+	tempDir := check.Return(ioutil.TempDir("", "ghostgres_template")).(string)
+	defer os.RemoveAll(tempDir)
+	cluster := &PostgresCluster{
+		Config:   spec.Config,
+		DataDir:  filepath.Join(tempDir, "data"),
+		InitOpts: spec.InitOpts,
+		RunOpts:  spec.RunOpts,
+		BinDir:   spec.BinDir,
+		Password: spec.Password,
+	}
+	if cluster.Config == nil {
+		cluster.Config = TestConfig
+	}
+	check.Error(cluster.InitContext(ctx))
+	if prepare != nil {
+		prepare(ctx, cluster)
+	}
+	t.publish(ctx, cluster, inputs)
+	return true
 }
 
 // DefaultTemplateDir is a convenience value used to refer to the
-// installed location of the ghostgres package. It is to be used as the
-// root location if you would like to have ghostgres manage all template
-// copies.
+// directory returned by TemplateStore. It is to be used as the root location
+// if you would like to have ghostgres manage all template copies.
 const DefaultTemplateDir = ""
 
 // DefaultTemplate is a convenience value used to refer to a default
@@ -90,9 +274,77 @@ const DefaultTemplateDir = ""
 // be used as the template name.
 const DefaultTemplate = ""
 
-// FromDefault is equivalent to FromTemplate(DefaultTemplateDir, DefaultTemplate, dest)
-func FromDefault(dest string) (p *PostgresCluster, err error) {
-	return FromTemplate(DefaultTemplateDir, DefaultTemplate, dest)
+// Template is a template created by EnsureTemplate.
+type Template struct {
+	// The directory containing the template
+	Path string
+	// Whether the template was created by EnsureTemplate
+	Created bool
+	// The binaries the template is verified against
+	binDir string
+}
+
+// Clone clones a cluster from the template exactly like FromTemplate.
+func (t *Template) Clone(dest string, opts ...CloneOption) (p *PostgresCluster, err error) {
+	defer recoverFault(&err)
+	return ghostgresTemplate(t.Path).clone(t.binDir, dest, opts), nil
+}
+
+// EnsureTemplate returns the template name in dir, freezing it first if it
+// does not exist. dir and name have the same behaviour as in Freeze. The
+// template is created by running initdb on a cluster with the Config,
+// InitOpts, RunOpts, BinDir and Password of spec in a temporary directory.
+// TestConfig is used if spec.Config is nil. This allows a fresh machine to
+// bootstrap the templates used by its tests:
+//
+//	pg, err := ghostgres.FindPostgres("latest")
+//	// Handle error
+//	tpl, err := ghostgres.EnsureTemplate(ghostgres.DefaultTemplateDir, "myapp",
+//		ghostgres.PostgresCluster{BinDir: pg.BinDir})
+//	// Handle error
+//	cluster, err := tpl.Clone("")
+//
+// Unlike FromTemplate the version of postgres used to locate the template is
+// that of spec.BinDir rather than the ghostgres_pg_bin_dir flag.
+//
+// An existing template is returned as is, even if it was created from a
+// different spec, unless it fails verification as described in FromTemplate
+// in which case it is rebuilt. Concurrent calls, including those from other
+// processes, create the template once.
+func EnsureTemplate(dir, name string, spec PostgresCluster) (t *Template, err error) {
+	return EnsureTemplateContext(context.Background(), dir, name, spec)
+}
+
+// EnsureTemplateContext is like EnsureTemplate but creates the template
+// bound to ctx.
+func EnsureTemplateContext(ctx context.Context, dir, name string, spec PostgresCluster) (t *Template, err error) {
+	defer recoverFault(&err)
+	tpl := newTemplateFor(dir, name, spec.BinDir)
+	created := tpl.ensure(ctx, spec, "", nil)
+	return &Template{Path: tpl.path(), Created: created, binDir: spec.BinDir}, nil
+}
+
+// ForTest clones a cluster from the default template into a temporary
+// directory, exactly like FromDefault(""), and sets t.Fatal as its failure
+// handler. This allows tests to skip error checks on the returned cluster.
+//
+//	cluster := ghostgres.ForTest(t)
+//	cluster.Start()
+//	defer cluster.Stop()
+//	cluster.WaitTillServing(time.Second)
+func ForTest(t testing.TB) *PostgresCluster {
+	t.Helper()
+	cluster, err := FromDefault("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.OnFailure = t.Fatal
+	return cluster
+}
+
+// FromDefault is equivalent to FromTemplate(DefaultTemplateDir, DefaultTemplate, dest, opts...)
+func FromDefault(dest string, opts ...CloneOption) (p *PostgresCluster, err error) {
+	return FromTemplate(DefaultTemplateDir, DefaultTemplate, dest, opts...)
 }
 
 // FromTemplate will attempt to clone a cluster from a template located at
@@ -105,10 +357,17 @@ func FromDefault(dest string) (p *PostgresCluster, err error) {
 // Freeze(dir, name) first before calling FromTemplate.
 //
 // If dest is empty a temporary directory is created for the clone and will
-// be deleted when Stop() is called on the cluster.
-func FromTemplate(dir, name, dest string) (p *PostgresCluster, err error) {
-	defer check.Recover(&err)
-	return newTemplate(dir, name).clone(dest), nil
+// be deleted when Stop() is called on the cluster. The clone can be configured
+// using opts as in Clone. Use WithEphemeral to place the temporary directory
+// on a tmpfs.
+//
+// The template is verified against the Manifest written by Freeze. An error
+// wrapping ErrTemplateInvalid is returned if the template has no manifest,
+// was built by a different postgres binary or its data no longer matches the
+// checksum. Use Delete and Freeze, or EnsureTemplate, to rebuild it.
+func FromTemplate(dir, name, dest string, opts ...CloneOption) (p *PostgresCluster, err error) {
+	defer recoverFault(&err)
+	return newTemplate(dir, name).clone(*pgBinDir, dest, opts), nil
 }
 
 // Freeze will save a template to
@@ -118,20 +377,39 @@ func FromTemplate(dir, name, dest string) (p *PostgresCluster, err error) {
 // where
 //	%dir%		directory into which to freeze. This will
 //			create a copy of the cluster into %dir%/data
-//			If %dir% is empty <path_to_ghostgres>/testdata/template is used.
+//			If %dir% is empty TemplateStore() is used.
 //	%name%		is the value of the parameter 'name'. If empty the value of
 //			the ghostgres_template flag is used.
 //	%pg_version%	is the result of calling PostgresVersion()
 //
-// If a frozen template exists it will return an error
+// If a frozen template exists it will return an error wrapping
+// ErrTemplateExists. A Manifest describing the template is saved with it.
+//
+// Freeze is safe to call concurrently from multiple processes. The template
+// is built in a temporary directory and renamed into place so FromTemplate
+// never sees a partially created template. To create a template if it is
+// missing and then clone it use
+//
+//	if err := cluster.Freeze(dir, name); err != nil && !errors.Is(err, ErrTemplateExists) {
+//		// fail
+//	}
+//	cloned, err := FromTemplate(dir, name, "")
 func (cluster *PostgresCluster) Freeze(dir, name string) (err error) {
-	defer check.Recover(&err)
-	return newTemplate(dir, name).createFrom(cluster)
+	return cluster.FreezeContext(context.Background(), dir, name)
+}
+
+// FreezeContext is like Freeze but copies the cluster bound to ctx.
+func (cluster *PostgresCluster) FreezeContext(ctx context.Context, dir, name string) (err error) {
+	defer cluster.handleFailure(&err)
+	defer recoverFault(&err)
+	return newTemplate(dir, name).createFrom(ctx, cluster)
 }
 
 // Delete will delete a saved template configuration. dir and name
 // have the same behaviour as in Freeze.
 func Delete(dir, name string) (err error) {
-	defer check.Recover(&err)
-	return os.RemoveAll(newTemplate(dir, name).path())
+	defer recoverFault(&err)
+	t := newTemplate(dir, name)
+	defer t.lock(context.Background(), true).unlock()
+	return os.RemoveAll(t.path())
 }
@@ -5,9 +5,9 @@ package ghostgres
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/surullabs/fault"
-	"io/ioutil"
 	. "launchpad.net/gocheck"
 	"os"
 	"path/filepath"
@@ -27,25 +27,16 @@ func TestCreateDefaults(t *testing.T) {
 	defer checkError(&gerr, t.Error)
 	defer check.Recover(&gerr)
 
-	defaultTpl := newTemplate(DefaultTemplateDir, DefaultTemplate)
 	version := postgresVersion()
-	if defaultTpl.exists() {
-		fmt.Println("Default template exists for version", version, "at", defaultTpl.path())
+	defaultTpl := testcheck.Return(EnsureTemplate(DefaultTemplateDir, DefaultTemplate, PostgresCluster{
+		Config:   TestConfigWithLogging,
+		BinDir:   *pgBinDir,
+		Password: "ghostgres",
+	})).(*Template)
+	if defaultTpl.Created {
+		fmt.Println("Created default template for version", version, "at", defaultTpl.Path)
 	} else {
-
-		fmt.Println("Creating default template for version", version, "at", defaultTpl.path())
-		tempDir := testcheck.Return(ioutil.TempDir("", "ghostgres_default")).(string)
-		defer func() { os.RemoveAll(tempDir) }()
-		cluster := &PostgresCluster{
-			Config:   TestConfigWithLogging,
-			BinDir:   *pgBinDir,
-			DataDir:  tempDir,
-			Password: "ghostgres",
-		}
-		testcheck.Error(cluster.Init())
-		testcheck.Error(cluster.Freeze(DefaultTemplateDir, DefaultTemplate))
-
-		fmt.Println("Created default template for version", version, "at", defaultTpl.path())
+		fmt.Println("Default template exists for version", version, "at", defaultTpl.Path)
 	}
 
 	// Now test that we can clone it.
@@ -53,6 +44,7 @@ func TestCreateDefaults(t *testing.T) {
 	cloned := testcheck.Return(FromDefault("")).(*PostgresCluster)
 	atClone := time.Now()
 	fmt.Printf("Cloning a new cluster takes %0.4f seconds\n", atClone.Sub(before).Seconds())
+	fmt.Println("Copied the data directory using", cloned.CloneStats())
 
 	testcheck.Error(cloned.Start())
 	defer cloned.Stop()
@@ -104,9 +96,10 @@ func (s *PostgresSuite) TestUtilFailures(c *C) {
 	})
 	checkPanic(c, ".*failed to parse postgres version from blah", func() { parseVersion("blah") })
 	checkPanic(c, ".*GOPATH is not set.*", func() {
-		oldPath := gopathFn
-		defer func() { gopathFn = oldPath }()
+		oldPath, oldCacheDir := gopathFn, userCacheDirFn
+		defer func() { gopathFn, userCacheDirFn = oldPath, oldCacheDir }()
 		gopathFn = func() string { return "" }
+		userCacheDirFn = func() (string, error) { return "", errors.New("no home") }
 		newTemplate(DefaultTemplateDir, DefaultTemplate)
 	})
 }
@@ -125,7 +118,7 @@ func (s *PostgresSuite) TestTemplating(c *C) {
 	c.Assert(
 		filepath.Dir(newTemplate(DefaultTemplateDir, DefaultTemplate).path()),
 		Equals,
-		testcheck.Return(filepath.Abs(filepath.Join(templateDir, *defaultName))).(string))
+		filepath.Join(testcheck.Return(TemplateStore()).(string), *defaultName))
 	cluster := initdb(c)
 	freezeDir := c.MkDir()
 	c.Assert(cluster.Freeze(freezeDir, "mytpl"), IsNil)
@@ -140,3 +133,51 @@ func (s *PostgresSuite) TestTemplating(c *C) {
 	cloned, err = FromTemplate(freezeDir, "mytpl", cloneDest)
 	c.Assert(err, ErrorMatches, ".*no such file.*")
 }
+
+func (s *PostgresSuite) TestTemplateStore(c *C) {
+	oldPath, oldCacheDir, oldEnv := gopathFn, userCacheDirFn, os.Getenv(TemplateStoreEnv)
+	defer func() {
+		gopathFn, userCacheDirFn = oldPath, oldCacheDir
+		*templateStoreDir = ""
+		os.Setenv(TemplateStoreEnv, oldEnv)
+	}()
+	os.Unsetenv(TemplateStoreEnv)
+	cacheDir := c.MkDir()
+	userCacheDirFn = func() (string, error) { return cacheDir, nil }
+
+	// Module mode, where the package is not in GOPATH.
+	gopath := c.MkDir()
+	gopathFn = func() string { return gopath }
+	c.Assert(testcheck.Return(TemplateStore()).(string), Equals, filepath.Join(cacheDir, "ghostgres", "template"))
+
+	pkgPath := filepath.Join(gopath, "src", "github.com", "surullabs", "ghostgres")
+	c.Assert(os.MkdirAll(pkgPath, 0700), IsNil)
+	c.Assert(testcheck.Return(TemplateStore()).(string), Equals, filepath.Join(pkgPath, templateDir))
+
+	os.Setenv(TemplateStoreEnv, "/from/env")
+	c.Assert(testcheck.Return(TemplateStore()).(string), Equals, "/from/env")
+	*templateStoreDir = "/from/flag"
+	c.Assert(testcheck.Return(TemplateStore()).(string), Equals, "/from/flag")
+}
+
+func (s *PostgresSuite) TestEnsureTemplate(c *C) {
+	dir := c.MkDir()
+	spec := *testCluster(c)
+	tpl, err := EnsureTemplate(dir, "ensured", spec)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, true)
+	c.Assert(tpl.Path, Equals, newTemplate(dir, "ensured").path())
+
+	again, err := EnsureTemplate(dir, "ensured", spec)
+	c.Assert(err, IsNil)
+	c.Assert(again.Created, Equals, false)
+	c.Assert(again.Path, Equals, tpl.Path)
+
+	cloned, err := tpl.Clone(filepath.Join(c.MkDir(), "clone"))
+	c.Assert(err, IsNil)
+	CheckCluster(cloned, c)
+
+	spec.BinDir = c.MkDir()
+	_, err = EnsureTemplate(dir, "ensured", spec)
+	c.Assert(err, ErrorMatches, ".*no such file or directory.*")
+}
@@ -0,0 +1,163 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// MigrationsTable is the table in which MigrateTemplate records the versions
+// of the migrations it applied.
+const MigrationsTable = "ghostgres_migrations"
+
+// LatestMigration selects the newest migration in MigrateTemplate.
+const LatestMigration int64 = -1
+
+// Migration is a single up migration loaded by LoadMigrations.
+type Migration struct {
+	// The version from the file name
+	Version int64
+	// The name of the file
+	Name string
+	// The contents of the file
+	SQL []byte
+}
+
+// Migrations describes the migrations applied by MigrateTemplate.
+type Migrations struct {
+	// The directory containing the migrations. Up migrations are named
+	// NNN_name.up.sql, as used by golang-migrate and goose, where NNN is the
+	// version. All other files are ignored.
+	FS fs.FS
+	// The database to which the migrations are applied. It is created if
+	// needed. If empty the postgres database is used.
+	Database string
+}
+
+func (m Migrations) database() string {
+	if m.Database == "" {
+		return "postgres"
+	}
+	return m.Database
+}
+
+var upMigration = regexp.MustCompile(`^([0-9]+)_.*\.up\.sql$`)
+
+// LoadMigrations returns the up migrations in the root of fsys sorted by
+// version. Migrations are named as described in Migrations.
+func LoadMigrations(fsys fs.FS) (migrations []Migration, err error) {
+	defer recoverFault(&err)
+	entries := check.Return(fs.ReadDir(fsys, ".")).([]fs.DirEntry)
+	versions := make(map[int64]string)
+	for _, entry := range entries {
+		match := upMigration.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version := check.Return(strconv.ParseInt(match[1], 10, 64)).(int64)
+		if other, found := versions[version]; found {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", other, entry.Name(), version)
+		}
+		versions[version] = entry.Name()
+		sql := check.Return(fs.ReadFile(fsys, entry.Name())).([]byte)
+		migrations = append(migrations, Migration{version, entry.Name(), sql})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrationTemplateName returns the name of the template created by
+// MigrateTemplate for the schema of name at version. Use it to find or
+// delete the template. Clone it using the Template returned by
+// MigrateTemplate, which uses the binaries in spec.BinDir.
+func MigrationTemplateName(name string, version int64) string {
+	return fmt.Sprintf("%s-v%d", name, version)
+}
+
+// upTo returns the migrations up to and including version.
+func upTo(migrations []Migration, version int64) ([]Migration, error) {
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations found")
+	}
+	if version == LatestMigration {
+		return migrations, nil
+	}
+	for i, m := range migrations {
+		if m.Version == version {
+			return migrations[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("no migration with version %d", version)
+}
+
+// apply creates the database and migrations table if needed and applies
+// every migration in its own transaction together with the row recording it.
+func (m Migrations) apply(ctx context.Context, c *PostgresCluster, migrations []Migration) {
+	withServer(ctx, c, func() {
+		if db := m.database(); db != "postgres" {
+			check.Error(c.CreateDatabase(db, ""))
+		}
+		check.Return(c.psqlScript(ctx, m.database(), bytes.NewReader([]byte(fmt.Sprintf(
+			"CREATE TABLE %s (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())",
+			quoteIdentifier(MigrationsTable))))))
+		for _, migration := range migrations {
+			var script bytes.Buffer
+			script.Write(migration.SQL)
+			fmt.Fprintf(&script, "\n;\nINSERT INTO %s (version, name) VALUES (%d, %s);\n",
+				quoteIdentifier(MigrationsTable), migration.Version, quoteLiteral(migration.Name))
+			if _, err := c.runPsql(ctx, m.database(), &script, "-1", "-f", "-"); err != nil {
+				check.Error(fmt.Errorf("applying %s: %w", migration.Name, err))
+			}
+		}
+	})
+}
+
+// MigrateTemplate returns a template initialized using spec, as in
+// EnsureTemplate, with the migrations up to and including version applied.
+// Use LatestMigration to apply all of them. Every migration is applied in
+// its own transaction, so migrations which cannot run in a transaction
+// block are not supported, and its version is recorded in MigrationsTable.
+//
+// The template is named MigrationTemplateName(name, version) which allows
+// tests of upgrade paths to clone the schema at any version:
+//
+//	migrations := ghostgres.Migrations{FS: os.DirFS("migrations")}
+//	tpl, err := ghostgres.MigrateTemplate(dir, "myapp", spec, migrations, 3)
+//	// Handle error
+//	cluster, err := tpl.Clone("")
+//	// Upgrade the cluster to the latest version and check the data
+//
+// Templates are built on first use and rebuilt if spec or any of the
+// migrations they contain change.
+func MigrateTemplate(dir, name string, spec PostgresCluster, m Migrations, version int64) (t *Template, err error) {
+	return MigrateTemplateContext(context.Background(), dir, name, spec, m, version)
+}
+
+// MigrateTemplateContext is like MigrateTemplate but builds the template
+// bound to ctx.
+func MigrateTemplateContext(ctx context.Context, dir, name string, spec PostgresCluster, m Migrations, version int64) (t *Template, err error) {
+	defer recoverFault(&err)
+	all := check.Return(LoadMigrations(m.FS)).([]Migration)
+	migrations := check.Return(upTo(all, version)).([]Migration)
+	version = migrations[len(migrations)-1].Version
+	if name == DefaultTemplate {
+		name = *defaultName
+	}
+	scripts := make([]seedScript, len(migrations))
+	for i, migration := range migrations {
+		scripts[i] = seedScript{migration.Name, migration.SQL}
+	}
+	inputs := seedHash(spec, m.database(), scripts)
+	tpl := newTemplateFor(dir, MigrationTemplateName(name, version), spec.BinDir)
+	created := tpl.ensure(ctx, spec, inputs, func(ctx context.Context, c *PostgresCluster) {
+		m.apply(ctx, c, migrations)
+	})
+	return &Template{Path: tpl.path(), Created: created, binDir: spec.BinDir}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"os"
+	"testing/fstest"
+	"time"
+)
+
+var testMigrations = fstest.MapFS{
+	"001_create_items.up.sql":   {Data: []byte("CREATE TABLE items (id int PRIMARY KEY);")},
+	"001_create_items.down.sql": {Data: []byte("DROP TABLE items;")},
+	"2_add_name.up.sql":         {Data: []byte("ALTER TABLE items ADD COLUMN name text;")},
+	"010_fill.up.sql":           {Data: []byte("INSERT INTO items VALUES (1, 'one');")},
+	"README.md":                 {Data: []byte("Not a migration")},
+}
+
+func (s *PostgresSuite) TestLoadMigrations(c *C) {
+	migrations, err := LoadMigrations(testMigrations)
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 3)
+	for i, version := range []int64{1, 2, 10} {
+		c.Assert(migrations[i].Version, Equals, version)
+	}
+	c.Assert(migrations[1].Name, Equals, "2_add_name.up.sql")
+	c.Assert(string(migrations[2].SQL), Equals, "INSERT INTO items VALUES (1, 'one');")
+
+	_, err = LoadMigrations(fstest.MapFS{
+		"001_a.up.sql": {Data: []byte("")},
+		"1_b.up.sql":   {Data: []byte("")},
+	})
+	c.Assert(err, ErrorMatches, "migrations .* have the same version 1")
+
+	latest, err := upTo(migrations, LatestMigration)
+	c.Assert(err, IsNil)
+	c.Assert(latest, HasLen, 3)
+	second, err := upTo(migrations, 2)
+	c.Assert(err, IsNil)
+	c.Assert(second, HasLen, 2)
+	_, err = upTo(migrations, 3)
+	c.Assert(err, ErrorMatches, "no migration with version 3")
+	_, err = upTo(nil, LatestMigration)
+	c.Assert(err, ErrorMatches, "no migrations found")
+	c.Assert(MigrationTemplateName("myapp", 2), Equals, "myapp-v2")
+}
+
+// withDB starts cluster and calls fn with a connection to database.
+func withDB(c *C, cluster *PostgresCluster, database string, fn func(db *sql.DB)) {
+	c.Assert(cluster.Start(), IsNil)
+	defer cluster.Stop()
+	c.Assert(cluster.WaitTillServing(time.Second), IsNil)
+	connStr, err := cluster.TestConnectString()
+	c.Assert(err, IsNil)
+	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=%s", connStr, database))
+	c.Assert(err, IsNil)
+	defer db.Close()
+	fn(db)
+}
+
+func migratedVersions(c *C, cluster *PostgresCluster, database string) (versions []int64) {
+	withDB(c, cluster, database, func(db *sql.DB) {
+		rows, err := db.Query("SELECT version FROM " + MigrationsTable + " ORDER BY version")
+		c.Assert(err, IsNil)
+		defer rows.Close()
+		for rows.Next() {
+			var version int64
+			c.Assert(rows.Scan(&version), IsNil)
+			versions = append(versions, version)
+		}
+	})
+	return
+}
+
+func (s *PostgresSuite) TestMigrateTemplate(c *C) {
+	dir := c.MkDir()
+	spec := *testCluster(c)
+	m := Migrations{FS: testMigrations, Database: "app"}
+	tpl, err := MigrateTemplate(dir, "migrated", spec, m, 2)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, true)
+	_, err = MigrateTemplate(dir, "migrated", spec, m, LatestMigration)
+	c.Assert(err, IsNil)
+
+	atTwo, err := FromTemplate(dir, MigrationTemplateName("migrated", 2), "")
+	c.Assert(err, IsNil)
+	c.Assert(migratedVersions(c, atTwo, "app"), DeepEquals, []int64{1, 2})
+	latest, err := FromTemplate(dir, MigrationTemplateName("migrated", 10), "")
+	c.Assert(err, IsNil)
+	c.Assert(migratedVersions(c, latest, "app"), DeepEquals, []int64{1, 2, 10})
+
+	// Changing a migration rebuilds the templates containing it.
+	changed := fstest.MapFS{}
+	for name, file := range testMigrations {
+		changed[name] = file
+	}
+	changed["2_add_name.up.sql"] = &fstest.MapFile{Data: []byte("ALTER TABLE items ADD COLUMN name varchar(10);")}
+	tpl, err = MigrateTemplate(dir, "migrated", spec, Migrations{FS: changed, Database: "app"}, 2)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, true)
+
+	// A failed migration is reported and no template is published.
+	changed["011_broken.up.sql"] = &fstest.MapFile{Data: []byte("INSERT INTO items VALUES (2, 'two'); CREATE TABLE broken (id int); NOT SQL;")}
+	_, err = MigrateTemplate(dir, "migrated", spec, Migrations{FS: changed}, LatestMigration)
+	c.Assert(err, ErrorMatches, "(?s).*applying 011_broken.up.sql.*")
+	_, err = os.Stat(newTemplateFor(dir, MigrationTemplateName("migrated", 11), spec.BinDir).path())
+	c.Assert(os.IsNotExist(err), Equals, true)
+	templates, err := ListTemplates(dir)
+	c.Assert(err, IsNil)
+	for _, t := range templates {
+		c.Assert(t.Name, Not(Equals), MigrationTemplateName("migrated", 11))
+	}
+}
+
+func (s *PostgresSuite) TestMigrationRollback(c *C) {
+	cluster := initdb(c)
+	changed := fstest.MapFS{}
+	for name, file := range testMigrations {
+		changed[name] = file
+	}
+	changed["011_broken.up.sql"] = &fstest.MapFile{Data: []byte("INSERT INTO items VALUES (2, 'two'); CREATE TABLE broken (id int); NOT SQL;")}
+	m := Migrations{FS: changed}
+	migrations, err := LoadMigrations(changed)
+	c.Assert(err, IsNil)
+	err = func() (err error) {
+		defer recoverFault(&err)
+		m.apply(context.Background(), cluster, migrations)
+		return nil
+	}()
+	c.Assert(err, ErrorMatches, "(?s).*applying 011_broken.up.sql.*")
+
+	// Earlier migrations are kept while everything done by the failing one,
+	// including recording it, is rolled back.
+	c.Assert(migratedVersions(c, cluster, "postgres"), DeepEquals, []int64{1, 2, 10})
+	withDB(c, cluster, "postgres", func(db *sql.DB) {
+		var ids, tables int
+		c.Assert(db.QueryRow("SELECT count(*) FROM items WHERE id = 2").Scan(&ids), IsNil)
+		c.Assert(ids, Equals, 0)
+		c.Assert(db.QueryRow("SELECT count(*) FROM pg_tables WHERE tablename = 'broken'").Scan(&tables), IsNil)
+		c.Assert(tables, Equals, 0)
+	})
+}
@@ -0,0 +1,237 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when acquiring a cluster from a closed Pool.
+var ErrPoolClosed = errors.New("pool is closed")
+
+// The time allowed for a pooled cluster to start serving.
+const poolStartTimeout = 30 * time.Second
+
+// The time allowed for a pooled cluster to stop before it is killed.
+const poolStopTimeout = 10 * time.Second
+
+type poolItem struct {
+	cluster *PostgresCluster
+	err     error
+}
+
+// Pool keeps a number of clusters cloned from a template started in the
+// background so that tests can acquire a running cluster without waiting for
+// it to be cloned and started. This is useful for large suites of parallel
+// tests. The total number of clusters, whether ready, acquired or being
+// started, is bounded so that a suite never runs more than a fixed number of
+// postgres processes.
+//
+// A Pool is safe for concurrent use.
+type Pool struct {
+	dir, name string
+	warm, max int
+	opts      []CloneOption
+
+	ready  chan poolItem
+	closed chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// The number of clusters that exist or are being started or stopped
+	size     int
+	starting int
+	waiting  int
+	isClosed bool
+}
+
+// NewPool creates a pool of clusters cloned from the template name in dir as
+// in FromTemplate using opts. It immediately starts warm clusters in the
+// background and never runs more than max clusters at a time. Since pooled
+// clusters run in parallel consider using WithFreePort.
+func NewPool(dir, name string, warm, max int, opts ...CloneOption) (pool *Pool, err error) {
+	if max < 1 || warm < 0 || warm > max {
+		return nil, fmt.Errorf("invalid pool size: %d warm clusters with a maximum of %d", warm, max)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pool = &Pool{
+		dir:  dir,
+		name: name,
+		warm: warm,
+		max:  max,
+		opts: opts,
+		// At most max clusters and max errors are ever ready.
+		ready:  make(chan poolItem, 2*max),
+		closed: make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	pool.mu.Lock()
+	pool.fill()
+	pool.mu.Unlock()
+	return pool, nil
+}
+
+// fill starts clusters until enough are ready or starting to satisfy the warm
+// count and all waiting callers of Acquire. It must be called with mu held.
+func (p *Pool) fill() {
+	for !p.isClosed && p.size < p.max && len(p.ready)+p.starting < p.warm+p.waiting {
+		p.size++
+		p.starting++
+		p.wg.Add(1)
+		go p.start()
+	}
+}
+
+func (p *Pool) start() {
+	defer p.wg.Done()
+	cluster, err := FromTemplate(p.dir, p.name, "", p.opts...)
+	if err == nil {
+		if err = cluster.Start(); err == nil {
+			ctx, cancel := context.WithTimeout(p.ctx, poolStartTimeout)
+			err = cluster.WaitTillServingContext(ctx)
+			cancel()
+		}
+		if err != nil {
+			cluster.StopWithMode(Fast, poolStopTimeout)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starting--
+	switch {
+	case err != nil:
+		// Failed clusters are not replaced until the error has been returned
+		// by Acquire to avoid repeatedly failing in the background. The
+		// error is dropped if the pool is already full.
+		p.size--
+		if len(p.ready) < p.max {
+			p.ready <- poolItem{err: err}
+		}
+	case p.isClosed:
+		p.stopLocked(cluster)
+	default:
+		p.ready <- poolItem{cluster: cluster}
+	}
+}
+
+// Acquire returns a running cluster from the pool, waiting until one is ready
+// or ctx is done. The cluster must be returned using Release or Recycle.
+func (p *Pool) Acquire(ctx context.Context) (cluster *PostgresCluster, err error) {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.waiting++
+	p.fill()
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.waiting--
+		p.fill()
+		p.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case item := <-p.ready:
+			if item.err != nil {
+				return nil, item.err
+			}
+			if item.cluster.Running() {
+				return item.cluster, nil
+			}
+			// The cluster exited while it was waiting in the pool.
+			p.discard(item.cluster)
+		case <-p.closed:
+			return nil, ErrPoolClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release stops and deletes a cluster acquired from the pool. The pool starts
+// a fresh cluster to replace it in the background if needed.
+func (p *Pool) Release(cluster *PostgresCluster) {
+	p.discard(cluster)
+}
+
+// Recycle returns a cluster acquired from the pool to the pool without
+// stopping it, so that it can be acquired again. Only recycle clusters whose
+// contents were not modified. A cluster which is no longer running is
+// released instead.
+func (p *Pool) Recycle(cluster *PostgresCluster) {
+	p.mu.Lock()
+	if p.isClosed || !cluster.Running() {
+		p.mu.Unlock()
+		p.discard(cluster)
+		return
+	}
+	defer p.mu.Unlock()
+	cluster.OnFailure = nil
+	p.ready <- poolItem{cluster: cluster}
+}
+
+func (p *Pool) discard(cluster *PostgresCluster) {
+	p.mu.Lock()
+	if !p.isClosed {
+		defer p.mu.Unlock()
+		p.stopLocked(cluster)
+		return
+	}
+	p.mu.Unlock()
+	// Close may already be waiting for the clusters stopped in the
+	// background, so clusters released after it are stopped right away.
+	cluster.OnFailure = nil
+	cluster.StopWithMode(Fast, poolStopTimeout)
+	p.mu.Lock()
+	p.size--
+	p.mu.Unlock()
+}
+
+// stopLocked stops cluster in the background. It must be called with mu
+// held. The slot used by the cluster is freed once it has stopped.
+func (p *Pool) stopLocked(cluster *PostgresCluster) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		cluster.OnFailure = nil
+		cluster.StopWithMode(Fast, poolStopTimeout)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.size--
+		p.fill()
+	}()
+}
+
+// Close stops all clusters that are ready or being started and waits for them
+// to be deleted. Clusters that have been acquired are not affected but must
+// still be released, which stops them before Release returns. Release all
+// clusters before calling Close to ensure that every cluster has been deleted
+// when Close returns.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		return
+	}
+	p.isClosed = true
+	close(p.closed)
+	p.cancel()
+	for len(p.ready) > 0 {
+		if item := <-p.ready; item.cluster != nil {
+			p.stopLocked(item.cluster)
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,81 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+func (s *PostgresSuite) TestPoolSizes(c *C) {
+	for _, size := range [][2]int{{0, 0}, {-1, 1}, {2, 1}} {
+		_, err := NewPool(c.MkDir(), "pool", size[0], size[1])
+		c.Assert(err, ErrorMatches, "invalid pool size.*")
+	}
+}
+
+func (s *PostgresSuite) TestReleaseAfterClose(c *C) {
+	pool, err := NewPool(c.MkDir(), "pool", 0, 2)
+	c.Assert(err, IsNil)
+	const released = 4
+	stopped := make(chan bool, released+2)
+	done := make(chan bool)
+	for i := 0; i < released; i++ {
+		go func() {
+			cluster := &PostgresCluster{onStop: func() { stopped <- true }}
+			pool.Release(cluster)
+			done <- true
+		}()
+	}
+	pool.Close()
+	for i := 0; i < released; i++ {
+		<-done
+	}
+	// Clusters released after Close are stopped before Release returns.
+	cluster := &PostgresCluster{onStop: func() { stopped <- true }}
+	pool.Release(cluster)
+	pool.Recycle(cluster)
+	c.Assert(len(stopped), Equals, released+2)
+}
+
+func (s *PostgresSuite) TestPool(c *C) {
+	freezeDir := c.MkDir()
+	c.Assert(initdb(c).Freeze(freezeDir, "pool"), IsNil)
+	pool, err := NewPool(freezeDir, "pool", 1, 2)
+	c.Assert(err, IsNil)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	first, err := pool.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(first.State(), Equals, Serving)
+	second, err := pool.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(second.DataDir, Not(Equals), first.DataDir)
+
+	// The pool is exhausted.
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	_, err = pool.Acquire(short)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	pool.Recycle(second)
+	recycled, err := pool.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(recycled, Equals, second)
+
+	pool.Release(first)
+	replacement, err := pool.Acquire(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(replacement.DataDir, Not(Equals), first.DataDir)
+	pool.Release(replacement)
+	pool.Release(recycled)
+
+	pool.Close()
+	c.Assert(first.Running(), Equals, false)
+	_, err = pool.Acquire(ctx)
+	c.Assert(err, Equals, ErrPoolClosed)
+}
@@ -0,0 +1,268 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerState describes the lifecycle state of the postgres server process
+// controlled by a PostgresCluster.
+type ServerState int
+
+const (
+	// NotStarted indicates that the server has never been started.
+	NotStarted ServerState = iota
+	// Starting indicates that the server process has been launched but
+	// has not yet been confirmed to accept connections.
+	Starting
+	// Serving indicates that the server has been confirmed to accept
+	// connections by WaitTillServing.
+	Serving
+	// Stopping indicates that a shutdown has been requested and the
+	// server process has not exited yet.
+	Stopping
+	// Exited indicates that the server process exited cleanly or as
+	// a result of a requested shutdown.
+	Exited
+	// Crashed indicates that the server process exited with an error
+	// without being asked to stop.
+	Crashed
+)
+
+var serverStateNames = []string{"not started", "starting", "serving", "stopping", "exited", "crashed"}
+
+func (s ServerState) String() string {
+	if s < 0 || int(s) >= len(serverStateNames) {
+		return "unknown"
+	}
+	return serverStateNames[s]
+}
+
+// alive returns true if the state describes a process that has not yet exited.
+func (s ServerState) alive() bool { return s == Starting || s == Serving || s == Stopping }
+
+// process supervises a single postgres server process. A goroutine owns the
+// call to exec.Cmd.Wait and records the exit status once the process terminates.
+type process struct {
+	*exec.Cmd
+	done chan struct{}
+	// The context the process was started with
+	ctx context.Context
+	// The configuration the process was started with
+	config []ConfigOpt
+	// Captured server output and its position when the process started
+	logs     *logBuffer
+	logStart int
+
+	mu      sync.Mutex
+	state   ServerState
+	exitErr error
+	// Set once the exit status has been consumed by PostgresCluster.Wait
+	waited bool
+}
+
+// supervise starts a goroutine waiting on cmd, which must already have been
+// started using ctx and config with its output captured in logs since logStart.
+func supervise(ctx context.Context, cmd *exec.Cmd, config []ConfigOpt, logs *logBuffer, logStart int) *process {
+	proc := &process{
+		Cmd:      cmd,
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		config:   append([]ConfigOpt(nil), config...),
+		logs:     logs,
+		logStart: logStart,
+		state:    Starting,
+	}
+	go proc.supervise()
+	return proc
+}
+
+func (p *process) supervise() {
+	err := p.Cmd.Wait()
+	if p.logs != nil {
+		p.logs.flush()
+	}
+	p.mu.Lock()
+	p.exitErr = cleanExit(err)
+	if p.state == Stopping || p.exitErr == nil {
+		p.state = Exited
+	} else {
+		p.state = Crashed
+	}
+	p.mu.Unlock()
+	close(p.done)
+}
+
+// cleanExit filters out the error returned when postgres exits as a result
+// of a SIGTERM, which is how a smart shutdown is requested.
+func cleanExit(err error) error {
+	if err != nil && err.Error() == "signal: terminated" {
+		return nil
+	}
+	return err
+}
+
+func (p *process) State() ServerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// transition moves the process to state to if it is currently in state from.
+func (p *process) transition(from, to ServerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == from {
+		p.state = to
+	}
+}
+
+// stopping marks the process as being asked to stop.
+func (p *process) stopping() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state.alive() {
+		p.state = Stopping
+	}
+}
+
+// consumed reports whether the exit status has been returned by Wait.
+func (p *process) consumed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waited
+}
+
+// consume marks the exit status as returned by Wait. It reports false if
+// another caller already consumed it.
+func (p *process) consume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waited {
+		return false
+	}
+	p.waited = true
+	return true
+}
+
+func (p *process) exitError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exitErr
+}
+
+// State returns the current state of the postgres server process.
+func (p *PostgresCluster) State() ServerState {
+	if p.proc == nil {
+		return NotStarted
+	}
+	return p.proc.State()
+}
+
+// Done returns a channel that is closed when the postgres server process
+// exits, whether as a result of Stop or otherwise. This makes it possible
+// to fail fast when a server dies in the middle of a test. It returns nil
+// if the server has never been started.
+func (p *PostgresCluster) Done() <-chan struct{} {
+	if p.proc == nil {
+		return nil
+	}
+	return p.proc.done
+}
+
+// ExitErr returns the error with which the postgres server process exited.
+// It returns nil if the server is still running, was never started or exited
+// cleanly. An exit caused by SIGTERM is treated as clean. The error is always
+// an *ExitError to which the most recent output of the server is attached.
+func (p *PostgresCluster) ExitErr() error {
+	if p.proc == nil {
+		return nil
+	}
+	return p.proc.exitErrorWithOutput()
+}
+
+// ShutdownMode selects how a running postgres server is asked to stop. See
+// http://www.postgresql.org/docs/current/static/server-shutdown.html
+// for details on each mode.
+type ShutdownMode int
+
+const (
+	// Smart waits for all clients to disconnect. It sends SIGTERM.
+	Smart ShutdownMode = iota
+	// Fast disconnects all clients and shuts down cleanly. It sends SIGINT.
+	Fast
+	// Immediate aborts all server processes without a clean shutdown. The
+	// next start will run crash recovery. It sends SIGQUIT.
+	Immediate
+	// Kill sends SIGKILL. It is only used as a last resort when escalating.
+	Kill
+)
+
+var shutdownSignals = []syscall.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL}
+var shutdownModeNames = []string{"smart", "fast", "immediate", "kill"}
+
+func (m ShutdownMode) String() string {
+	if m < 0 || int(m) >= len(shutdownModeNames) {
+		return "unknown"
+	}
+	return shutdownModeNames[m]
+}
+
+func (m ShutdownMode) signal() syscall.Signal { return shutdownSignals[m] }
+
+// waitFor waits for the process to exit for up to timeout or until ctx is done
+// and reports whether it exited. A timeout <= 0 waits until ctx is done.
+func (p *process) waitFor(ctx context.Context, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-p.done:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-expired:
+		return false
+	}
+}
+
+// exitErrorWithOutput returns an *ExitError if the process exited unsuccessfully
+// or nil otherwise.
+func (p *process) exitErrorWithOutput() error {
+	err := p.exitError()
+	if err == nil {
+		return nil
+	}
+	exitErr := &ExitError{Code: -1, Err: err}
+	if p.logs != nil {
+		exitErr.Output = p.logs.since(p.logStart, errorLogLines)
+	}
+	if p.ProcessState != nil {
+		exitErr.Code = p.ProcessState.ExitCode()
+		if sig := p.exitSignal(); sig > 0 {
+			exitErr.Signal = sig
+		}
+	}
+	return exitErr
+}
+
+// exitSignal returns the signal that terminated the process or -1 if it was
+// not terminated by a signal. It must only be called once the process has exited.
+func (p *process) exitSignal() syscall.Signal {
+	if p.ProcessState == nil {
+		return -1
+	}
+	if status, ok := p.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal()
+	}
+	return -1
+}
@@ -0,0 +1,150 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SQLSTATE returned by a server that is still starting up, recovering or
+// shutting down. See http://www.postgresql.org/docs/current/static/errcodes-appendix.html
+const sqlStateCannotConnectNow = "57P03"
+
+const protocolVersion3 = 196608
+
+// How often WaitTillServing pings the server.
+const pingInterval = 10 * time.Millisecond
+
+// The maximum time allowed for a single ping.
+const pingTimeout = 1 * time.Second
+
+// serverError is an ErrorResponse sent by the server during startup.
+type serverError struct {
+	Code    string
+	Message string
+}
+
+func (e *serverError) Error() string { return fmt.Sprintf("%s (SQLSTATE %s)", e.Message, e.Code) }
+
+// listenHost returns the host to use for TCP connections as derived from
+// listen_addresses or an empty string if the server does not listen on TCP.
+func (p *PostgresCluster) listenHost() string {
+	addrs, _ := p.configValue("listen_addresses")
+	addrs = strings.Trim(strings.TrimSpace(addrs), "'\"")
+	host := strings.TrimSpace(strings.Split(addrs, ",")[0])
+	switch host {
+	case "*":
+		return "localhost"
+	case "0.0.0.0":
+		return "127.0.0.1"
+	case "::":
+		return "::1"
+	}
+	return host
+}
+
+// serverAddress returns the network and address on which the server accepts
+// connections. TCP is used if listen_addresses is set, else the unix socket.
+func (p *PostgresCluster) serverAddress() (network, address string, err error) {
+	defer recoverFault(&err)
+	if host := p.listenHost(); host != "" {
+		port := check.Return(p.Port()).(int)
+		return "tcp", net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	return "unix", check.Return(p.SocketFile()).(string), nil
+}
+
+// ping performs a startup handshake with the server in the same manner as
+// pg_isready. A server is considered to be serving if it responds to a
+// startup message with anything other than a "cannot connect now" error.
+// Authentication is never attempted. A single ping takes at most pingTimeout.
+func ping(ctx context.Context, network, address, user string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err = conn.Write(startupMessage(user, "postgres")); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	msgType, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if msgType != 'E' {
+		// Any other response, usually an authentication request, means the
+		// server is accepting connections.
+		return nil
+	}
+	var length int32
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if length < 4 {
+		return errors.New("invalid error response from server")
+	}
+	body := make([]byte, length-4)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	if serr := parseErrorResponse(body); serr.Code == sqlStateCannotConnectNow {
+		return serr
+	}
+	// Errors such as authentication failures or a missing database still
+	// mean that the server is serving.
+	return nil
+}
+
+func startupMessage(user, database string) []byte {
+	var params bytes.Buffer
+	for _, kv := range [][2]string{{"user", user}, {"database", database}} {
+		params.WriteString(kv[0])
+		params.WriteByte(0)
+		params.WriteString(kv[1])
+		params.WriteByte(0)
+	}
+	params.WriteByte(0)
+	msg := make([]byte, 8, 8+params.Len())
+	binary.BigEndian.PutUint32(msg[0:4], uint32(8+params.Len()))
+	binary.BigEndian.PutUint32(msg[4:8], protocolVersion3)
+	return append(msg, params.Bytes()...)
+}
+
+func parseErrorResponse(body []byte) *serverError {
+	serr := &serverError{}
+	for len(body) > 1 {
+		field := body[0]
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : end+1])
+		body = body[end+2:]
+		switch field {
+		case 'C':
+			serr.Code = value
+		case 'M':
+			serr.Message = value
+		}
+	}
+	return serr
+}
@@ -0,0 +1,93 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	. "launchpad.net/gocheck"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+func errorResponse(code, message string) []byte {
+	var body bytes.Buffer
+	for _, field := range []string{"SFATAL", "C" + code, "M" + message} {
+		body.WriteString(field)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+	msg := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+body.Len()))
+	return append(msg, body.Bytes()...)
+}
+
+// fakeServer listens on a unix socket and replies to every startup message with response.
+func fakeServer(c *C, response []byte) (net.Listener, string) {
+	address := filepath.Join(c.MkDir(), ".s.PGSQL.5432")
+	listener, err := net.Listen("unix", address)
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var length int32
+			if binary.Read(conn, binary.BigEndian, &length) == nil {
+				io.CopyN(io.Discard, conn, int64(length-4))
+				conn.Write(response)
+			}
+			conn.Close()
+		}
+	}()
+	return listener, address
+}
+
+func (s *PostgresSuite) TestPing(c *C) {
+	authRequest := []byte{'R', 0, 0, 0, 8, 0, 0, 0, 5}
+	for _, tc := range []struct {
+		response []byte
+		matches  string
+	}{
+		{authRequest, ""},
+		{errorResponse("28P01", "password authentication failed"), ""},
+		{errorResponse(sqlStateCannotConnectNow, "the database system is starting up"), ".*starting up.*57P03.*"},
+	} {
+		listener, address := fakeServer(c, tc.response)
+		err := ping(context.Background(), "unix", address, "ghostgres")
+		listener.Close()
+		if tc.matches == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, tc.matches)
+		}
+	}
+	c.Assert(ping(context.Background(), "unix", filepath.Join(c.MkDir(), "missing"), "ghostgres"), ErrorMatches, ".*no such file.*")
+}
+
+func (s *PostgresSuite) TestServerAddress(c *C) {
+	cluster := testCluster(c)
+	network, address, err := cluster.serverAddress()
+	c.Assert(err, IsNil)
+	c.Assert(network, Equals, "unix")
+	c.Assert(address, Equals, testcheck.Return(cluster.SocketFile()).(string))
+
+	cluster.Config = []ConfigOpt{{"port", "6543", ""}, {"listen_addresses", "'*'", ""}}
+	network, address, err = cluster.serverAddress()
+	c.Assert(err, IsNil)
+	c.Assert(network, Equals, "tcp")
+	c.Assert(address, Equals, "localhost:6543")
+}
+
+func (s *PostgresSuite) TestWaitTillServingExit(c *C) {
+	cluster := initdb(c)
+	// The server exits immediately so waiting must not run until the timeout.
+	cluster.RunOpts = []ConfigOpt{{Key: "--fake_flag"}}
+	c.Assert(cluster.Start(), IsNil)
+	c.Assert(cluster.WaitTillServing(5*time.Second), ErrorMatches, "(?s).*exited before serving.*exit status 1.*fake_flag.*")
+}
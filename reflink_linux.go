@@ -0,0 +1,38 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"os"
+	"syscall"
+)
+
+// The FICLONE ioctl request, _IOW(0x94, 9, int), from linux/fs.h
+const ficlone = 0x40049409
+
+// reflinkFile creates dest as a copy-on-write clone of src.
+func reflinkFile(src, dest string, mode os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		switch errno {
+		case syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+			return errReflinkUnsupported
+		}
+		return errno
+	}
+	return out.Chmod(mode)
+}
@@ -0,0 +1,13 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+//go:build !linux
+
+package ghostgres
+
+import "os"
+
+// reflinkFile is only supported on Linux.
+func reflinkFile(src, dest string, mode os.FileMode) error {
+	return errReflinkUnsupported
+}
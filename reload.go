@@ -0,0 +1,107 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	surultpl "github.com/surullabs/goutil/template"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// The pg_settings context of settings which can only be changed by restarting the server.
+const restartContext = "postmaster"
+
+// ApplyConfig re-renders postgresql.conf from Config. If the server is running
+// it is sent a SIGHUP so that it reloads its configuration. Settings that were
+// changed since the server was started and which can only be changed by a
+// restart, as determined by their context in pg_settings, are returned.
+// Call Restart to apply them.
+func (p *PostgresCluster) ApplyConfig() (pending []string, err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Initialized(), ErrNotInitialized)
+	check.Error(surultpl.WriteFile(p.configFile(), postgresqlConfTemplate, p, 0600))
+	if !p.Running() {
+		return nil, nil
+	}
+	contexts := check.Return(p.settingContexts()).(map[string]string)
+	for _, name := range changedSettings(p.proc.config, p.Config) {
+		if contexts[name] == restartContext {
+			pending = append(pending, name)
+		}
+	}
+	check.Error(p.proc.Process.Signal(syscall.SIGHUP))
+	return
+}
+
+// Restart stops a running server with a fast shutdown and starts it again from
+// the same data directory. Unlike Stop it does not run the cleanup registered
+// by FromTemplate. Call WaitTillServing to wait for the restarted server.
+func (p *PostgresCluster) Restart() (err error) {
+	return p.RestartContext(context.Background())
+}
+
+// RestartContext is like Restart but kills the server if it has not stopped
+// by the time ctx is done. The restarted server remains bound to the context
+// it was originally started with.
+func (p *PostgresCluster) RestartContext(ctx context.Context) (err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Running(), ErrNotRunning)
+	startCtx := p.proc.ctx
+	onStop := p.onStop
+	p.onStop = nil
+	_, err = p.StopWithModeContext(ctx, Fast, 0)
+	p.onStop = onStop
+	check.Error(err)
+	return p.StartContext(startCtx)
+}
+
+// settingContexts returns the pg_settings context of every setting supported
+// by the server binary keyed by the lower case setting name.
+func (p *PostgresCluster) settingContexts() (contexts map[string]string, err error) {
+	defer recoverFault(&err)
+	out := check.Return(exec.Command(filepath.Join(p.BinDir, "postgres"), "--describe-config").Output()).([]byte)
+	contexts = make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Each line is a tab separated list starting with the name and context.
+		if fields := strings.Split(scanner.Text(), "\t"); len(fields) > 1 {
+			contexts[strings.ToLower(fields[0])] = fields[1]
+		}
+	}
+	return contexts, scanner.Err()
+}
+
+// changedSettings returns the sorted lower case names of settings which differ
+// between two configurations. Setting names are case insensitive and, as in
+// postgresql.conf, the last occurrence of a setting wins.
+func changedSettings(before, after []ConfigOpt) (changed []string) {
+	values := func(opts []ConfigOpt) map[string]string {
+		m := make(map[string]string)
+		for _, opt := range opts {
+			m[strings.ToLower(opt.Key)] = opt.Value
+		}
+		return m
+	}
+	old, updated := values(before), values(after)
+	for name, value := range updated {
+		if oldValue, found := old[name]; !found || oldValue != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, found := updated[name]; !found {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return
+}
@@ -0,0 +1,151 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// The time allowed for a cluster being seeded to start serving.
+const seedStartTimeout = 30 * time.Second
+
+// Seed lists the SQL scripts applied to a template by SeedTemplate.
+type Seed struct {
+	// Paths of SQL files which are applied first, in order
+	Files []string
+	// If not nil every .sql file in FS is applied after Files in lexical
+	// order of their paths. Name migrations such as 001_schema.sql,
+	// 002_fixtures.sql to apply them in the intended order.
+	FS fs.FS
+	// The database to which the scripts are applied. If empty the postgres
+	// database is used.
+	Database string
+}
+
+type seedScript struct {
+	name string
+	sql  []byte
+}
+
+func (s Seed) scripts() (scripts []seedScript, err error) {
+	for _, file := range s.Files {
+		sql, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, seedScript{file, sql})
+	}
+	if s.FS == nil {
+		return scripts, nil
+	}
+	err = fs.WalkDir(s.FS, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || path.Ext(name) != ".sql" {
+			return err
+		}
+		sql, err := fs.ReadFile(s.FS, name)
+		if err == nil {
+			scripts = append(scripts, seedScript{name, sql})
+		}
+		return err
+	})
+	return scripts, err
+}
+
+func (s Seed) database() string {
+	if s.Database == "" {
+		return "postgres"
+	}
+	return s.Database
+}
+
+// seedHash hashes everything that determines the contents of a seeded
+// template except for the postgres version, which is part of its path. It
+// is recorded as the inputs of the template.
+func seedHash(spec PostgresCluster, database string, scripts []seedScript) string {
+	hash := sha256.New()
+	settings := check.Return(json.Marshal([]interface{}{spec.Config, spec.InitOpts, spec.RunOpts, spec.Password, database})).([]byte)
+	hash.Write(settings)
+	for _, script := range scripts {
+		fmt.Fprintf(hash, "\x00%s\x00%d\x00", script.name, len(script.sql))
+		hash.Write(script.sql)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// apply runs scripts against the database of the seed on c.
+func (s Seed) apply(ctx context.Context, c *PostgresCluster, scripts []seedScript) {
+	withServer(ctx, c, func() {
+		for _, script := range scripts {
+			if _, err := c.psqlScript(ctx, s.database(), bytes.NewReader(script.sql)); err != nil {
+				check.Error(fmt.Errorf("applying %s: %w", script.name, err))
+			}
+		}
+	})
+}
+
+// withServer starts c, calls fn once it is serving and shuts c down cleanly.
+func withServer(ctx context.Context, c *PostgresCluster, fn func()) {
+	check.Error(c.StartContext(ctx))
+	stopped := false
+	defer func() {
+		if !stopped {
+			c.StopWithMode(Immediate, 0)
+		}
+	}()
+	startCtx, cancel := context.WithTimeout(ctx, seedStartTimeout)
+	defer cancel()
+	check.Error(c.WaitTillServingContext(startCtx))
+	fn()
+	stopped = true
+	used := check.Return(c.StopWithModeContext(ctx, Fast, 0)).(ShutdownMode)
+	requireTrue(used == Fast, fmt.Errorf("seeded cluster was not shut down cleanly: needed %v shutdown", used))
+}
+
+// SeedTemplate returns a template initialized using spec, as in
+// EnsureTemplate, to which the scripts in seed have been applied. The
+// template is built on first use by starting the cluster, applying every
+// script in order using psql, stopping the cluster cleanly and freezing it.
+//
+// The template is named
+//
+//	<name>-<hash>
+//
+// in dir where hash is derived from spec and the names and contents of the
+// scripts, so that changing the schema automatically produces a new
+// template while templates built from other inputs remain usable. Use
+// Delete or Prune to remove templates which are no longer needed.
+//
+//	tpl, err := ghostgres.SeedTemplate(ghostgres.DefaultTemplateDir, "myapp",
+//		ghostgres.PostgresCluster{BinDir: binDir},
+//		ghostgres.Seed{FS: os.DirFS("migrations")})
+//	// Handle error
+//	cluster, err := tpl.Clone("")
+func SeedTemplate(dir, name string, spec PostgresCluster, seed Seed) (t *Template, err error) {
+	return SeedTemplateContext(context.Background(), dir, name, spec, seed)
+}
+
+// SeedTemplateContext is like SeedTemplate but builds the template bound to
+// ctx.
+func SeedTemplateContext(ctx context.Context, dir, name string, spec PostgresCluster, seed Seed) (t *Template, err error) {
+	defer recoverFault(&err)
+	scripts := check.Return(seed.scripts()).([]seedScript)
+	if name == DefaultTemplate {
+		name = *defaultName
+	}
+	hash := seedHash(spec, seed.database(), scripts)
+	tpl := newTemplateFor(dir, name+"-"+hash, spec.BinDir)
+	created := tpl.ensure(ctx, spec, hash, func(ctx context.Context, c *PostgresCluster) {
+		seed.apply(ctx, c, scripts)
+	})
+	return &Template{Path: tpl.path(), Created: created, binDir: spec.BinDir}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"path/filepath"
+	"testing/fstest"
+	"time"
+)
+
+func (s *PostgresSuite) TestSeedScripts(c *C) {
+	file := filepath.Join(c.MkDir(), "first.sql")
+	c.Assert(ioutil.WriteFile(file, []byte("SELECT 1;"), 0600), IsNil)
+	seed := Seed{
+		Files: []string{file},
+		FS: fstest.MapFS{
+			"002_fixtures.sql":     {Data: []byte("INSERT ...")},
+			"001_schema.sql":       {Data: []byte("CREATE ...")},
+			"README.md":            {Data: []byte("Not applied")},
+			"003/001_more.sql":     {Data: []byte("ALTER ...")},
+			"003/ignored.down.txt": {Data: []byte("DROP ...")},
+		},
+	}
+	scripts, err := seed.scripts()
+	c.Assert(err, IsNil)
+	var names []string
+	for _, script := range scripts {
+		names = append(names, script.name)
+	}
+	c.Assert(names, DeepEquals, []string{file, "001_schema.sql", "002_fixtures.sql", "003/001_more.sql"})
+	c.Assert(string(scripts[1].sql), Equals, "CREATE ...")
+
+	_, err = Seed{Files: []string{filepath.Join(c.MkDir(), "missing.sql")}}.scripts()
+	c.Assert(err, ErrorMatches, ".*no such file.*")
+}
+
+func (s *PostgresSuite) TestSeedHash(c *C) {
+	spec := PostgresCluster{Config: TestConfig}
+	scripts := []seedScript{{"001.sql", []byte("CREATE TABLE a ()")}, {"002.sql", []byte("CREATE TABLE b ()")}}
+	hash := seedHash(spec, "postgres", scripts)
+	c.Assert(hash, HasLen, 16)
+	c.Assert(seedHash(spec, "postgres", scripts), Equals, hash)
+	// Only inputs which change the template change the hash.
+	spec.BinDir = "/elsewhere"
+	c.Assert(seedHash(spec, "postgres", scripts), Equals, hash)
+
+	changed := []seedScript{{"001.sql", []byte("CREATE TABLE a (id int)")}, scripts[1]}
+	reordered := []seedScript{scripts[1], scripts[0]}
+	for _, other := range []string{
+		seedHash(spec, "other", scripts),
+		seedHash(spec, "postgres", changed),
+		seedHash(spec, "postgres", reordered),
+		seedHash(spec, "postgres", scripts[:1]),
+		seedHash(PostgresCluster{Config: TestConfigWithLogging}, "postgres", scripts),
+	} {
+		c.Assert(other, Not(Equals), hash)
+	}
+}
+
+func (s *PostgresSuite) TestSeedTemplate(c *C) {
+	dir := c.MkDir()
+	spec := *testCluster(c)
+	seed := Seed{FS: fstest.MapFS{
+		"001_schema.sql":   {Data: []byte("CREATE TABLE items (id int PRIMARY KEY);")},
+		"002_fixtures.sql": {Data: []byte("INSERT INTO items VALUES (1), (2), (3);")},
+	}}
+	tpl, err := SeedTemplate(dir, "seeded", spec, seed)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, true)
+	c.Assert(filepath.Base(filepath.Dir(tpl.Path)), Matches, "seeded-[0-9a-f]{16}")
+	tpl, err = SeedTemplate(dir, "seeded", spec, seed)
+	c.Assert(err, IsNil)
+	c.Assert(tpl.Created, Equals, false)
+
+	cloned, err := tpl.Clone("")
+	c.Assert(err, IsNil)
+	c.Assert(cloned.Start(), IsNil)
+	defer cloned.Stop()
+	c.Assert(cloned.WaitTillServing(time.Second), IsNil)
+	connStr, err := cloned.TestConnectString()
+	c.Assert(err, IsNil)
+	db, err := sql.Open("postgres", fmt.Sprintf("%s dbname=postgres", connStr))
+	c.Assert(err, IsNil)
+	defer db.Close()
+	var count int
+	c.Assert(db.QueryRow("SELECT count(*) FROM items").Scan(&count), IsNil)
+	c.Assert(count, Equals, 3)
+
+	// Changing a script creates a new template next to the old one.
+	seed.FS.(fstest.MapFS)["002_fixtures.sql"] = &fstest.MapFile{Data: []byte("INSERT INTO items VALUES (1), (2);")}
+	changed, err := SeedTemplate(dir, "seeded", spec, seed)
+	c.Assert(err, IsNil)
+	c.Assert(changed.Created, Equals, true)
+	c.Assert(changed.Path, Not(Equals), tpl.Path)
+
+	// A failing script is reported with its name and no template is created.
+	seed.FS.(fstest.MapFS)["003_broken.sql"] = &fstest.MapFile{Data: []byte("NOT SQL;")}
+	_, err = SeedTemplate(dir, "seeded", spec, seed)
+	c.Assert(err, ErrorMatches, "(?s).*applying 003_broken.sql.*")
+	templates, err := ListTemplates(dir)
+	c.Assert(err, IsNil)
+	c.Assert(templates, HasLen, 2)
+}
@@ -0,0 +1,142 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TemplateInfo describes a template found by ListTemplates.
+type TemplateInfo struct {
+	// The name of the template as passed to Freeze
+	Name string
+	// The postgres version the template was created for
+	Version string
+	// The directory containing the template
+	Path string
+	// The disk space used by the template in bytes
+	Size int64
+	// When the template was created
+	Created time.Time
+	// The manifest of the template or nil if it has none
+	Manifest *Manifest
+}
+
+// ListTemplates returns all templates in dir sorted by name and by
+// descending postgres version. If dir is DefaultTemplateDir the directory
+// returned by TemplateStore is used. Templates which are being created are
+// not listed.
+func ListTemplates(dir string) (templates []TemplateInfo, err error) {
+	defer recoverFault(&err)
+	if dir == DefaultTemplateDir {
+		dir = templateStore()
+	}
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	check.Error(err)
+	for _, name := range names {
+		if !name.IsDir() {
+			continue
+		}
+		versions := check.Return(ioutil.ReadDir(filepath.Join(dir, name.Name()))).([]os.FileInfo)
+		for _, version := range versions {
+			t := ghostgresTemplate(filepath.Join(dir, name.Name(), version.Name()))
+			// Staging directories are named <version>.tmp<suffix>
+			if !version.IsDir() || strings.Contains(version.Name(), ".tmp") || !t.exists() {
+				continue
+			}
+			templates = append(templates, t.info(name.Name(), version.Name()))
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Name != templates[j].Name {
+			return templates[i].Name < templates[j].Name
+		}
+		return versionLess(templates[j].Version, templates[i].Version)
+	})
+	return templates, nil
+}
+
+func (t ghostgresTemplate) info(name, version string) TemplateInfo {
+	info := TemplateInfo{
+		Name:    name,
+		Version: version,
+		Path:    t.path(),
+		Size:    check.Return(dirSize(t.path())).(int64),
+	}
+	if m, err := t.readManifest(); err == nil {
+		info.Manifest = m
+		info.Created = m.Created
+	} else {
+		info.Created = check.Return(os.Stat(t.config())).(os.FileInfo).ModTime()
+	}
+	return info
+}
+
+// versionLess compares postgres versions such as 9.3.5 or 17beta1 as
+// described in Version.Compare. Versions which cannot be parsed are
+// compared as strings.
+func versionLess(a, b string) bool {
+	av, aErr := ParseVersion(a)
+	bv, bErr := ParseVersion(b)
+	if aErr != nil || bErr != nil {
+		return a < b
+	}
+	return av.Less(bv)
+}
+
+// PrunePolicy selects the templates removed by Prune. A template is removed
+// if any of the rules matches.
+type PrunePolicy struct {
+	// Keep only the newest KeepVersions postgres versions of every template.
+	// All versions are kept if this is zero.
+	KeepVersions int
+	// Remove templates for postgres versions that are not provided by any of
+	// the postgres binaries in these directories. This is skipped if it is
+	// empty.
+	InstalledBinDirs []string
+}
+
+// Prune removes the templates in dir selected by policy and returns them.
+// dir has the same behaviour as in ListTemplates. Templates are locked as
+// in Delete so a template being cloned is not removed until the clone
+// completes.
+func Prune(dir string, policy PrunePolicy) (removed []TemplateInfo, err error) {
+	defer recoverFault(&err)
+	templates := check.Return(ListTemplates(dir)).([]TemplateInfo)
+	var installed map[string]bool
+	if len(policy.InstalledBinDirs) > 0 {
+		installed = make(map[string]bool)
+		for _, binDir := range policy.InstalledBinDirs {
+			installed[postgresVersionIn(binDir)] = true
+		}
+	}
+	kept := make(map[string]int)
+	for _, info := range templates {
+		prune := installed != nil && !installed[info.Version]
+		if !prune && policy.KeepVersions > 0 {
+			// Templates are sorted by descending version within a name.
+			kept[info.Name]++
+			prune = kept[info.Name] > policy.KeepVersions
+		}
+		if !prune {
+			continue
+		}
+		t := ghostgresTemplate(info.Path)
+		l := t.lock(context.Background(), true)
+		err := os.RemoveAll(t.path())
+		l.unlock()
+		check.Error(err)
+		removed = append(removed, info)
+	}
+	return removed, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"fmt"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fakeTemplate creates a template on disk without running initdb.
+func fakeTemplate(c *C, dir, name, version string, created time.Time) {
+	t := ghostgresTemplate(filepath.Join(dir, name, version))
+	c.Assert(os.MkdirAll(t.data(), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(t.data(), "PG_VERSION"), []byte(version), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(t.config(), []byte("{}"), 0600), IsNil)
+	manifest := fmt.Sprintf(`{"Version": %d, "Created": %q}`, manifestVersion, created.Format(time.RFC3339))
+	c.Assert(ioutil.WriteFile(t.manifestPath(), []byte(manifest), 0600), IsNil)
+}
+
+// fakeBinDir creates a directory with a postgres binary reporting version.
+func fakeBinDir(c *C, version string) string {
+	dir := c.MkDir()
+	script := fmt.Sprintf("#!/bin/sh\necho 'postgres (PostgreSQL) %s'\n", version)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "postgres"), []byte(script), 0700), IsNil)
+	return dir
+}
+
+func templateVersions(templates []TemplateInfo) (versions []string) {
+	for _, t := range templates {
+		versions = append(versions, t.Name+"/"+t.Version)
+	}
+	return
+}
+
+func (s *PostgresSuite) TestVersionLess(c *C) {
+	c.Assert(versionLess("9.3.5", "9.3.10"), Equals, true)
+	c.Assert(versionLess("9.4.0", "9.3.10"), Equals, false)
+	c.Assert(versionLess("9.3", "9.3.1"), Equals, true)
+	c.Assert(versionLess("9.3.1", "9.3.1"), Equals, false)
+	c.Assert(versionLess("9.6.24", "10.1"), Equals, true)
+	c.Assert(versionLess("17beta1", "17.0"), Equals, true)
+}
+
+func (s *PostgresSuite) TestListTemplates(c *C) {
+	dir := c.MkDir()
+	templates, err := ListTemplates(filepath.Join(dir, "missing"))
+	c.Assert(err, IsNil)
+	c.Assert(templates, HasLen, 0)
+
+	created := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	fakeTemplate(c, dir, "b", "9.3.5", created)
+	fakeTemplate(c, dir, "a", "9.3.5", created)
+	fakeTemplate(c, dir, "a", "9.3.10", created)
+	// Templates being created are ignored
+	fakeTemplate(c, dir, "a", "9.4.0.tmp1234", created)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a", "9.4.0.lock"), nil, 0600), IsNil)
+
+	templates, err = ListTemplates(dir)
+	c.Assert(err, IsNil)
+	c.Assert(templateVersions(templates), DeepEquals, []string{"a/9.3.10", "a/9.3.5", "b/9.3.5"})
+	c.Assert(templates[0].Path, Equals, filepath.Join(dir, "a", "9.3.10"))
+	c.Assert(templates[0].Size > 0, Equals, true)
+	c.Assert(templates[0].Created.Equal(created), Equals, true)
+	c.Assert(templates[0].Manifest.Version, Equals, manifestVersion)
+}
+
+func (s *PostgresSuite) TestPrune(c *C) {
+	dir := c.MkDir()
+	now := time.Now()
+	for _, version := range []string{"9.2.8", "9.3.4", "9.3.5"} {
+		fakeTemplate(c, dir, "a", version, now)
+	}
+	fakeTemplate(c, dir, "b", "9.2.8", now)
+
+	removed, err := Prune(dir, PrunePolicy{KeepVersions: 2})
+	c.Assert(err, IsNil)
+	c.Assert(templateVersions(removed), DeepEquals, []string{"a/9.2.8"})
+
+	removed, err = Prune(dir, PrunePolicy{InstalledBinDirs: []string{fakeBinDir(c, "9.3.5")}})
+	c.Assert(err, IsNil)
+	c.Assert(templateVersions(removed), DeepEquals, []string{"a/9.3.4", "b/9.2.8"})
+
+	templates, err := ListTemplates(dir)
+	c.Assert(err, IsNil)
+	c.Assert(templateVersions(templates), DeepEquals, []string{"a/9.3.5"})
+}
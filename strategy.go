@@ -0,0 +1,213 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// CloneStrategy copies the data directory of a cluster when cloning it.
+type CloneStrategy interface {
+	// Name identifies the strategy in CloneStats
+	Name() string
+	// Copy copies the directory tree src to dest which does not exist.
+	// It must stop and return an error once ctx is done.
+	Copy(ctx context.Context, src, dest string) error
+}
+
+// The built in clone strategies. Use DetectCloneStrategy to pick the fastest
+// one supported by the file system.
+var (
+	// CopyStrategy copies every file using pure Go, preserving permissions
+	// and symbolic links.
+	CopyStrategy CloneStrategy = fileStrategy{"copy", copyFile}
+	// ReflinkStrategy creates copy-on-write clones of every file using the
+	// FICLONE ioctl. This is only supported on Linux by file systems such as
+	// btrfs and XFS and only if src and dest are on the same file system.
+	ReflinkStrategy CloneStrategy = fileStrategy{"reflink", reflinkFile}
+	// CpStrategy runs cp -r and so only works on systems with a cp command.
+	CpStrategy CloneStrategy = cpStrategy{}
+)
+
+// CloneStats describes how a cluster was cloned.
+type CloneStats struct {
+	// The name of the CloneStrategy used
+	Strategy string
+	// The time taken to copy the data directory
+	Duration time.Duration
+	// Whether the clone was placed on a tmpfs by WithEphemeral
+	Tmpfs bool
+}
+
+func (s CloneStats) String() string {
+	if s.Tmpfs {
+		return fmt.Sprintf("%s to tmpfs in %0.4f seconds", s.Strategy, s.Duration.Seconds())
+	}
+	return fmt.Sprintf("%s in %0.4f seconds", s.Strategy, s.Duration.Seconds())
+}
+
+// CloneStats returns how this cluster was cloned. It is empty if the cluster
+// was not created by Clone or FromTemplate.
+func (p *PostgresCluster) CloneStats() CloneStats { return p.cloneStats }
+
+// WithCloneStrategy copies the data directory of the clone using strategy
+// instead of the one picked by DetectCloneStrategy.
+func WithCloneStrategy(strategy CloneStrategy) CloneOption {
+	return func(o *cloneOptions) { o.strategy = strategy }
+}
+
+// errReflinkUnsupported is returned by reflinkFile if reflinks are not
+// supported for a source and destination.
+var errReflinkUnsupported = errors.New("reflinks are not supported")
+
+// DetectCloneStrategy returns the fastest strategy for copying the data
+// directory src into destDir. It returns ReflinkStrategy if a file from src
+// can be reflinked into destDir and CopyStrategy otherwise. It never returns
+// a hard link strategy since one is only safe for files known to be
+// immutable, see NewHardlinkStrategy.
+func DetectCloneStrategy(src, destDir string) CloneStrategy {
+	probeDir, err := ioutil.TempDir(destDir, ".ghostgres_reflink")
+	if err != nil {
+		return CopyStrategy
+	}
+	defer os.RemoveAll(probeDir)
+	// Every data directory contains PG_VERSION
+	if reflinkFile(filepath.Join(src, "PG_VERSION"), filepath.Join(probeDir, "PG_VERSION"), 0600) != nil {
+		return CopyStrategy
+	}
+	return ReflinkStrategy
+}
+
+// NewHardlinkStrategy returns a strategy which creates hard links for files
+// for which immutable returns true and copies all others. The template and
+// every clone share the inode of a hard linked file so a change made by any
+// of them is visible to all. Since postgres modifies relation and WAL files
+// in place, immutable must only return true for files postgres never writes.
+// If immutable is nil only PG_VERSION files are linked. Files which cannot be
+// linked, such as those on a different file system, are copied instead.
+//
+// Hard linking is opt-in only. Whether a relation file is ever written again
+// depends on how the clone is used, not on its name, so no predicate can
+// safely be derived from the data directory alone. Callers who know that,
+// say, the files of a read only tablespace are never modified can link them
+// by passing WithCloneStrategy(NewHardlinkStrategy(pred)).
+func NewHardlinkStrategy(immutable func(relPath string) bool) CloneStrategy {
+	if immutable == nil {
+		immutable = func(relPath string) bool { return filepath.Base(relPath) == "PG_VERSION" }
+	}
+	return hardlinkStrategy{immutable}
+}
+
+type fileStrategy struct {
+	name     string
+	copyFile func(src, dest string, mode os.FileMode) error
+}
+
+func (s fileStrategy) Name() string { return s.name }
+
+func (s fileStrategy) Copy(ctx context.Context, src, dest string) error {
+	return copyTree(ctx, src, dest, func(_, srcFile, destFile string, mode os.FileMode) error {
+		return s.copyFile(srcFile, destFile, mode)
+	})
+}
+
+type hardlinkStrategy struct {
+	immutable func(relPath string) bool
+}
+
+func (hardlinkStrategy) Name() string { return "hardlink" }
+
+func (s hardlinkStrategy) Copy(ctx context.Context, src, dest string) error {
+	return copyTree(ctx, src, dest, func(relPath, srcFile, destFile string, mode os.FileMode) error {
+		if s.immutable(relPath) && os.Link(srcFile, destFile) == nil {
+			return nil
+		}
+		return copyFile(srcFile, destFile, mode)
+	})
+}
+
+type cpStrategy struct{}
+
+func (cpStrategy) Name() string { return "cp" }
+
+func (cpStrategy) Copy(ctx context.Context, src, dest string) error {
+	if out, err := exec.CommandContext(ctx, "cp", "-r", src, dest).CombinedOutput(); err != nil {
+		return fmt.Errorf("cp failed: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// copyTree recreates the directory tree src at dest, preserving permissions
+// and symbolic links, and calls copyFile for every regular file. Other files,
+// such as stale sockets, are skipped.
+func copyTree(ctx context.Context, src, dest string, copyFile func(relPath, srcFile, destFile string, mode os.FileMode) error) error {
+	// Directory permissions are applied once all files have been copied in
+	// case a directory is not writable.
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, relPath)
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			dirs = append(dirs, dirMode{target, mode.Perm()})
+			return os.Mkdir(target, 0700)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(relPath, path, target, mode.Perm())
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+		err = os.Chmod(dirs[i].path, dirs[i].mode)
+	}
+	return err
+}
+
+func copyFile(src, dest string, mode os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Chmod(mode)
+}
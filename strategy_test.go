@@ -0,0 +1,80 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"context"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+// strategyTree creates a small tree resembling a data directory.
+func strategyTree(c *C) string {
+	src := filepath.Join(c.MkDir(), "src")
+	c.Assert(os.MkdirAll(filepath.Join(src, "base", "1"), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "PG_VERSION"), []byte("9.3\n"), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "base", "1", "1234"), []byte("relation"), 0640), IsNil)
+	c.Assert(os.Symlink("base", filepath.Join(src, "link")), IsNil)
+	// Directories which are not writable are copied with their permissions.
+	c.Assert(os.Chmod(filepath.Join(src, "base", "1"), 0500), IsNil)
+	return src
+}
+
+func checkTreeCopy(c *C, src, dest string) {
+	for _, file := range []string{"PG_VERSION", "base/1/1234"} {
+		srcInfo, err := os.Stat(filepath.Join(src, file))
+		c.Assert(err, IsNil)
+		destInfo, err := os.Stat(filepath.Join(dest, file))
+		c.Assert(err, IsNil)
+		c.Assert(destInfo.Mode(), Equals, srcInfo.Mode())
+		srcData, _ := ioutil.ReadFile(filepath.Join(src, file))
+		destData, _ := ioutil.ReadFile(filepath.Join(dest, file))
+		c.Assert(string(destData), Equals, string(srcData))
+	}
+	info, err := os.Stat(filepath.Join(dest, "base", "1"))
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0500))
+	link, err := os.Readlink(filepath.Join(dest, "link"))
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "base")
+}
+
+func (s *PostgresSuite) TestCloneStrategies(c *C) {
+	src := strategyTree(c)
+	for _, strategy := range []CloneStrategy{CopyStrategy, NewHardlinkStrategy(nil), DetectCloneStrategy(src, c.MkDir())} {
+		dest := filepath.Join(c.MkDir(), strategy.Name())
+		c.Assert(strategy.Copy(context.Background(), src, dest), IsNil)
+		checkTreeCopy(c, src, dest)
+	}
+}
+
+func (s *PostgresSuite) TestHardlinkStrategy(c *C) {
+	src := strategyTree(c)
+	dest := filepath.Join(c.MkDir(), "dest")
+	c.Assert(NewHardlinkStrategy(nil).Copy(context.Background(), src, dest), IsNil)
+	srcInfo, _ := os.Stat(filepath.Join(src, "PG_VERSION"))
+	destInfo, _ := os.Stat(filepath.Join(dest, "PG_VERSION"))
+	c.Assert(os.SameFile(srcInfo, destInfo), Equals, true)
+	srcInfo, _ = os.Stat(filepath.Join(src, "base", "1", "1234"))
+	destInfo, _ = os.Stat(filepath.Join(dest, "base", "1", "1234"))
+	c.Assert(os.SameFile(srcInfo, destInfo), Equals, false)
+}
+
+func (s *PostgresSuite) TestCloneStrategyCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := CopyStrategy.Copy(ctx, strategyTree(c), filepath.Join(c.MkDir(), "dest"))
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (s *PostgresSuite) TestCloneWithStrategy(c *C) {
+	cluster := initdb(c)
+	c.Assert(cluster.CloneStats(), Equals, CloneStats{})
+	cloned, err := cluster.Clone(filepath.Join(c.MkDir(), "cloned"), WithCloneStrategy(CopyStrategy))
+	c.Assert(err, IsNil)
+	c.Assert(cloned.CloneStats().Strategy, Equals, "copy")
+	CheckCluster(cloned, c)
+}
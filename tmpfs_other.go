@@ -0,0 +1,12 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+//go:build !linux
+
+package ghostgres
+
+// tmpfsFree only detects a tmpfs on Linux.
+func tmpfsFree(dir string) (free uint64, isTmpfs bool) { return 0, false }
+
+// availableMemory is only known on Linux.
+func availableMemory() (uint64, bool) { return 0, false }
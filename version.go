@@ -0,0 +1,191 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is a postgres version such as 9.3.5, 16.2 or 17beta1. Releases
+// before 10 have a two part major version, 9.3, followed by a patch level.
+// Later releases have a single part major version followed by a minor
+// version, so Patch is always zero for them.
+type Version struct {
+	Major, Minor, Patch int
+	// The pre-release tag such as beta1, rc2 or devel. It is empty for
+	// releases.
+	Pre string
+}
+
+var versionPattern = regexp.MustCompile(`([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?((?:devel|alpha|beta|rc)[0-9]*)?`)
+
+// Pre-release tags in release order.
+var preReleases = []string{"devel", "alpha", "beta", "rc"}
+
+// ParseVersion parses the first version found in s, which may be the output
+// of postgres --version or the value of the server_version setting. Missing
+// components are zero and distribution suffixes are ignored, so all of
+//
+//	postgres (PostgreSQL) 9.3.5
+//	postgres (PostgreSQL) 16.2 (Debian 16.2-1.pgdg120+2)
+//	postgres (PostgreSQL) 17beta1
+//
+// are accepted.
+func ParseVersion(s string) (Version, error) {
+	match := versionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Version{}, fmt.Errorf("failed to parse postgres version from %s", s)
+	}
+	var parts [3]int
+	for i := range parts {
+		if match[i+1] != "" {
+			n, err := strconv.Atoi(match[i+1])
+			if err != nil {
+				return Version{}, fmt.Errorf("failed to parse postgres version from %s: %v", s, err)
+			}
+			parts[i] = n
+		}
+	}
+	return Version{Major: parts[0], Minor: parts[1], Patch: parts[2], Pre: match[4]}, nil
+}
+
+// ParseServerVersionNum parses the value of the server_version_num setting,
+// for instance 90305 for 9.3.5 or 160002 for 16.2. Pre-releases have the
+// number of the release they precede.
+func ParseServerVersionNum(s string) (Version, error) {
+	num, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || num <= 0 {
+		return Version{}, fmt.Errorf("invalid server_version_num %q", s)
+	}
+	if num >= 100000 {
+		return Version{Major: num / 10000, Minor: num % 10000}, nil
+	}
+	return Version{Major: num / 10000, Minor: num / 100 % 100, Patch: num % 100}, nil
+}
+
+// String formats the version as postgres does, for instance 9.3.5, 16.2 or
+// 17beta1. It is used to name template directories.
+func (v Version) String() string {
+	if v.Major >= 10 {
+		if v.Pre != "" && v.Minor == 0 {
+			return fmt.Sprintf("%d%s", v.Major, v.Pre)
+		}
+		return fmt.Sprintf("%d.%d%s", v.Major, v.Minor, v.Pre)
+	}
+	if v.Pre != "" && v.Patch == 0 {
+		return fmt.Sprintf("%d.%d%s", v.Major, v.Minor, v.Pre)
+	}
+	return fmt.Sprintf("%d.%d.%d%s", v.Major, v.Minor, v.Patch, v.Pre)
+}
+
+// MajorVersion returns the major version, which determines the on disk
+// format of a cluster. It is 9.3 for 9.3.5 and 16 for 16.2.
+func (v Version) MajorVersion() string {
+	if v.Major >= 10 {
+		return strconv.Itoa(v.Major)
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// components returns the numeric components of the version as printed by
+// String.
+func (v Version) components() []int {
+	if v.Major >= 10 {
+		return []int{v.Major, v.Minor}
+	}
+	return []int{v.Major, v.Minor, v.Patch}
+}
+
+// preRank orders pre-release tags before the release they precede.
+func (v Version) preRank() (rank, n int) {
+	if v.Pre == "" {
+		return len(preReleases), 0
+	}
+	for i, tag := range preReleases {
+		if strings.HasPrefix(v.Pre, tag) {
+			n, _ = strconv.Atoi(v.Pre[len(tag):])
+			return i, n
+		}
+	}
+	return -1, 0
+}
+
+// Compare returns -1, 0 or 1 if v is older than, the same as or newer than
+// o. Pre-releases are older than the release they precede, so
+// 17devel < 17beta1 < 17rc1 < 17.0.
+func (v Version) Compare(o Version) int {
+	vr, vn := v.preRank()
+	or, on := o.preRank()
+	for _, pair := range [][2]int{
+		{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}, {vr, or}, {vn, on},
+	} {
+		if pair[0] < pair[1] {
+			return -1
+		} else if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Less reports whether v is older than o.
+func (v Version) Less(o Version) bool { return v.Compare(o) < 0 }
+
+// AtLeast reports whether v is the same as or newer than the version with the
+// given components, ignoring pre-release tags. It is intended for feature
+// checks such as
+//
+//	if v.AtLeast(12) {
+//		// recovery.conf is no longer supported
+//	}
+//	if v.AtLeast(9, 6) {
+//		// ...
+//	}
+func (v Version) AtLeast(components ...int) bool {
+	return compareComponents(v.components(), components) >= 0
+}
+
+// compareComponents compares version components treating missing ones as
+// zero.
+func compareComponents(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var an, bn int
+		if i < len(a) {
+			an = a[i]
+		}
+		if i < len(b) {
+			bn = b[i]
+		}
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Version returns the version of the postgres binaries in BinDir.
+func (p *PostgresCluster) Version() (v Version, err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	return postgresVersionOf(p.BinDir), nil
+}
+
+// ServerVersion returns the version reported by the running server through
+// the server_version_num setting.
+func (p *PostgresCluster) ServerVersion() (v Version, err error) {
+	defer p.handleFailure(&err)
+	defer recoverFault(&err)
+	requireTrue(p.Running(), ErrNotRunning)
+	return p.serverVersion(), nil
+}
+
+func (p *PostgresCluster) serverVersion() Version {
+	out := check.Return(p.psql("postgres", "SHOW server_version_num")).(string)
+	return check.Return(ParseServerVersionNum(out)).(Version)
+}
@@ -0,0 +1,83 @@
+// Copyright 2014, Surul Software Labs GmbH
+// All rights reserved.
+
+package ghostgres
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (s *PostgresSuite) TestParseVersion(c *C) {
+	for output, expected := range map[string]Version{
+		"postgres (PostgreSQL) 9.3.5":                            {9, 3, 5, ""},
+		"postgres (PostgreSQL) 16.2":                             {16, 2, 0, ""},
+		"postgres (PostgreSQL) 16.2 (Debian 16.2-1.pgdg120+2)":   {16, 2, 0, ""},
+		"postgres (PostgreSQL) 14.11 (Ubuntu 14.11-0ubuntu0.22)": {14, 11, 0, ""},
+		"postgres (PostgreSQL) 17beta1":                          {17, 0, 0, "beta1"},
+		"postgres (PostgreSQL) 18devel":                          {18, 0, 0, "devel"},
+		"postgres (PostgreSQL) 9.4rc1":                           {9, 4, 0, "rc1"},
+		"16":                                                     {16, 0, 0, ""},
+	} {
+		version, err := ParseVersion(output)
+		c.Assert(err, IsNil)
+		c.Assert(version, Equals, expected, Commentf("%s", output))
+	}
+	_, err := ParseVersion("blah")
+	c.Assert(err, ErrorMatches, "failed to parse postgres version from blah")
+}
+
+func (s *PostgresSuite) TestParseServerVersionNum(c *C) {
+	for num, expected := range map[string]Version{
+		"90305":    {9, 3, 5, ""},
+		"90624\n":  {9, 6, 24, ""},
+		"100001":   {10, 1, 0, ""},
+		" 160002 ": {16, 2, 0, ""},
+	} {
+		version, err := ParseServerVersionNum(num)
+		c.Assert(err, IsNil)
+		c.Assert(version, Equals, expected, Commentf("%q", num))
+	}
+	for _, invalid := range []string{"", "16.2", "-1"} {
+		_, err := ParseServerVersionNum(invalid)
+		c.Assert(err, ErrorMatches, "invalid server_version_num.*")
+	}
+}
+
+func (s *PostgresSuite) TestVersionString(c *C) {
+	for _, version := range []string{"9.3.5", "9.4beta2", "9.4.1", "10.0", "16.2", "17beta1", "17rc1", "18devel"} {
+		parsed, err := ParseVersion(version)
+		c.Assert(err, IsNil)
+		c.Assert(parsed.String(), Equals, version)
+	}
+	c.Assert(Version{Major: 9, Minor: 3, Patch: 5}.MajorVersion(), Equals, "9.3")
+	c.Assert(Version{Major: 16, Minor: 2}.MajorVersion(), Equals, "16")
+}
+
+func (s *PostgresSuite) TestVersionCompare(c *C) {
+	ordered := []string{"9.3.5", "9.3.10", "9.4beta1", "9.4rc1", "9.4.0", "10.1", "17devel", "17beta1", "17beta2", "17rc1", "17.0", "17.1"}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			av, _ := ParseVersion(a)
+			bv, _ := ParseVersion(b)
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			c.Assert(av.Compare(bv), Equals, expected, Commentf("%s %s", a, b))
+			c.Assert(av.Less(bv), Equals, i < j)
+		}
+	}
+}
+
+func (s *PostgresSuite) TestVersionAtLeast(c *C) {
+	old := Version{Major: 9, Minor: 6, Patch: 24}
+	c.Assert(old.AtLeast(9, 6), Equals, true)
+	c.Assert(old.AtLeast(9, 6, 25), Equals, false)
+	c.Assert(old.AtLeast(10), Equals, false)
+	beta := Version{Major: 17, Pre: "beta1"}
+	c.Assert(beta.AtLeast(17), Equals, true)
+	c.Assert(beta.AtLeast(16, 4), Equals, true)
+	c.Assert(beta.AtLeast(17, 1), Equals, false)
+}